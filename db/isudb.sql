@@ -32,3 +32,20 @@ CREATE TABLE `adding` (
   PRIMARY KEY (`room_name`,`time`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
 
+CREATE TABLE `item_catalog` (
+  `version` varchar(64) COLLATE utf8mb4_bin NOT NULL,
+  `items` longtext COLLATE utf8mb4_bin NOT NULL,
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `room_catalog` (
+  `room_name` varchar(191) COLLATE utf8mb4_bin NOT NULL,
+  `version` varchar(64) COLLATE utf8mb4_bin NOT NULL,
+  PRIMARY KEY (`room_name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+CREATE TABLE `schema_version` (
+  `id` tinyint(4) NOT NULL,
+  `version` int(11) NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
@@ -7,10 +7,6 @@ import (
 	"github.com/izumin5210/ro/types"
 )
 
-var (
-	addingStore ro.Store
-)
-
 type Adding struct {
 	ro.Model
 	RoomName string `json:"-" db:"room_name" redis:"room_name"`
@@ -28,11 +24,3 @@ var addingScorerFuncs = []types.ScorerFunc{
 		return fmt.Sprintf("%s:time", a.RoomName), a.Time
 	},
 }
-
-func initAddingStore() {
-	var err error
-	addingStore, err = ro.New(redisPool.Get, &Adding{}, ro.WithScorers(addingScorerFuncs))
-	if err != nil {
-		panic(err)
-	}
-}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin は Authorization: Bearer {config.AdminToken} を要求する。
+// config.AdminToken が空の場合は管理用エンドポイントを使えない
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			writeAdminError(w, http.StatusForbidden, "ISU_ADMIN_TOKEN is not set")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// setAdminToken は他のホストの管理用エンドポイントへのリクエストに認証情報を付ける
+func setAdminToken(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+config.AdminToken)
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	assert := assert.New(t)
+	defer func(token string) { config.AdminToken = token }(config.AdminToken)
+
+	h := requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	call := func(auth string) int {
+		req := httptest.NewRequest("POST", "/admin/reset", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w.Code
+	}
+
+	config.AdminToken = ""
+	assert.Equal(http.StatusForbidden, call("Bearer "))
+
+	config.AdminToken = "secret"
+	assert.Equal(http.StatusUnauthorized, call(""))
+	assert.Equal(http.StatusUnauthorized, call("Bearer wrong"))
+	assert.Equal(http.StatusNoContent, call("Bearer secret"))
+}
@@ -7,10 +7,6 @@ import (
 	"github.com/izumin5210/ro/types"
 )
 
-var (
-	buyingStore ro.Store
-)
-
 type Buying struct {
 	ro.Model
 	RoomName string `db:"room_name" redis:"room_name"`
@@ -33,11 +29,3 @@ var buyingScorerFuncs = []types.ScorerFunc{
 		return fmt.Sprintf("%s:time", b.RoomName), b.Time
 	},
 }
-
-func initBuyingStore() {
-	var err error
-	buyingStore, err = ro.New(redisPool.Get, &Buying{}, ro.WithScorers(buyingScorerFuncs))
-	if err != nil {
-		panic(err)
-	}
-}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsCodec は websocket で送受信するメッセージのエンコード方式。
+// クライアントはサブプロトコル (Sec-WebSocket-Protocol) か /ws/{room_name}?encoding= で選ぶ。デフォルトは json
+type wsCodec interface {
+	name() string
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	unmarshal(data []byte, v interface{}) error
+}
+
+var wsCodecs = []wsCodec{msgpackCodec{}, jsonCodec{}}
+
+type jsonCodec struct{}
+
+func (jsonCodec) name() string     { return "json" }
+func (jsonCodec) messageType() int { return websocket.TextMessage }
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) name() string     { return "msgpack" }
+func (msgpackCodec) messageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	return marshalMsgpack(v)
+}
+
+// unmarshal は MessagePack を一度 JSON にしてから読む。GameRequest は小さいので問題にならない
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	x, err := unmarshalMsgpack(data)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func codecByName(name string) wsCodec {
+	for _, c := range wsCodecs {
+		if c.name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// selectCodec はエンコード方式を選ぶ。
+// サブプロトコルがネゴシエートされていればそれを、そうでなければ ?encoding= を使う
+func selectCodec(r *http.Request, subprotocol string) wsCodec {
+	if c := codecByName(subprotocol); c != nil {
+		return c
+	}
+	if c := codecByName(r.URL.Query().Get("encoding")); c != nil {
+		return c
+	}
+	return jsonCodec{}
+}
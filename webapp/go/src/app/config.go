@@ -0,0 +1,372 @@
+package main
+
+import (
+	"compress/flate"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config はアプリケーションの設定。
+// デフォルト値, 設定ファイル (-config か ISU_CONFIG, .toml か .yaml), 環境変数, フラグの順に上書きする。
+// フラグ名は設定ファイルのキーを . でつないだもの (例: -db.host)
+type Config struct {
+	Listen             string   `toml:"listen" yaml:"listen" env:"ISU_LISTEN" usage:"address to listen on"`
+	PprofListen        string   `toml:"pprof_listen" yaml:"pprof_listen" env:"ISU_PPROF_LISTEN" usage:"address for pprof in debug mode (empty to disable)"`
+	Debug              bool     `toml:"debug" yaml:"debug" env:"DEBUG" usage:"enable debug logging and pprof"`
+	WebHosts           []string `toml:"web_hosts" yaml:"web_hosts" env:"ISU_WEB_HOSTS" usage:"comma separated host:port of every web host"`
+	SelfHost           string   `toml:"self_host" yaml:"self_host" env:"ISU_SELF_HOST" usage:"host:port of this host in web_hosts (guessed from hostname if empty)"`
+	AdminToken         string   `toml:"admin_token" yaml:"admin_token" env:"ISU_ADMIN_TOKEN" usage:"bearer token for admin endpoints and /initialize (required)" secret:"true"`
+	OpenInitialize     bool     `toml:"open_initialize" yaml:"open_initialize" env:"ISU_OPEN_INITIALIZE" usage:"serve /initialize without the admin token"`
+	ShutdownTimeoutSec int      `toml:"shutdown_timeout_sec" yaml:"shutdown_timeout_sec" env:"ISU_SHUTDOWN_TIMEOUT_SEC" usage:"seconds to wait for connections to close on shutdown"`
+	MasterItems        string   `toml:"master_items" yaml:"master_items" env:"ISU_MASTER_ITEMS" usage:"master item file (.json, .yaml, .csv, .sql); empty to load m_item from MySQL"`
+
+	DB        DBConfig        `toml:"db" yaml:"db"`
+	Redis     RedisConfig     `toml:"redis" yaml:"redis"`
+	Game      GameConfig      `toml:"game" yaml:"game"`
+	WebSocket WebSocketConfig `toml:"websocket" yaml:"websocket"`
+	Placement PlacementConfig `toml:"placement" yaml:"placement"`
+}
+
+type DBConfig struct {
+	Host         string `toml:"host" yaml:"host" env:"ISU_DB_HOST" usage:"MySQL host"`
+	Port         int    `toml:"port" yaml:"port" env:"ISU_DB_PORT" usage:"MySQL port"`
+	User         string `toml:"user" yaml:"user" env:"ISU_DB_USER" usage:"MySQL user"`
+	Password     string `toml:"password" yaml:"password" env:"ISU_DB_PASSWORD" usage:"MySQL password" secret:"true"`
+	Name         string `toml:"name" yaml:"name" env:"ISU_DB_NAME" usage:"MySQL database"`
+	MaxOpenConns int    `toml:"max_open_conns" yaml:"max_open_conns" env:"ISU_DB_MAX_OPEN_CONNS" usage:"max open MySQL connections"`
+	// MySQL は master_items が空の場合か game.store が mysql の場合だけ使う
+	ConnectTimeoutSec int `toml:"connect_timeout_sec" yaml:"connect_timeout_sec" env:"ISU_DB_CONNECT_TIMEOUT_SEC" usage:"seconds to keep retrying the first MySQL connection"`
+}
+
+type RedisConfig struct {
+	URL       string `toml:"url" yaml:"url" env:"REDIS_URL" usage:"local Redis URL"`
+	SharedURL string `toml:"shared_url" yaml:"shared_url" env:"SHARED_REDIS_URL" usage:"Redis URL shared by every web host"`
+}
+
+type GameConfig struct {
+	Store            string `toml:"store" yaml:"store" env:"ISU_GAME_STORE" usage:"game store backend (redis, mysql, memory)"`
+	StatusIntervalMS int    `toml:"status_interval_ms" yaml:"status_interval_ms" env:"ISU_STATUS_INTERVAL_MS" usage:"milliseconds between GameStatus broadcasts"`
+	HorizonMS        int    `toml:"horizon_ms" yaml:"horizon_ms" env:"ISU_SIMULATION_HORIZON_MS" usage:"milliseconds simulated ahead in GameStatus"`
+}
+
+type WebSocketConfig struct {
+	Compression       bool     `toml:"compression" yaml:"compression" env:"ISU_WS_COMPRESSION" usage:"negotiate permessage-deflate"`
+	CompressionLevel  int      `toml:"compression_level" yaml:"compression_level" env:"ISU_WS_COMPRESSION_LEVEL" usage:"flate compression level"`
+	ReadBufferSize    int      `toml:"read_buffer_size" yaml:"read_buffer_size" env:"ISU_WS_READ_BUFFER_SIZE" usage:"websocket read buffer bytes"`
+	WriteBufferSize   int      `toml:"write_buffer_size" yaml:"write_buffer_size" env:"ISU_WS_WRITE_BUFFER_SIZE" usage:"websocket write buffer bytes"`
+	AllowedOrigins    []string `toml:"allowed_origins" yaml:"allowed_origins" env:"ISU_WS_ALLOWED_ORIGINS" usage:"comma separated Origin hosts (empty to allow all)"`
+	Subprotocols      []string `toml:"subprotocols" yaml:"subprotocols" env:"ISU_WS_SUBPROTOCOLS" usage:"comma separated subprotocols in order of preference"`
+	MaxProtocolErrors int      `toml:"max_protocol_errors" yaml:"max_protocol_errors" env:"ISU_WS_MAX_PROTOCOL_ERRORS" usage:"close the connection after this many malformed messages"`
+	MaxMessageSize    int64    `toml:"max_message_size" yaml:"max_message_size" env:"ISU_WS_MAX_MESSAGE_SIZE" usage:"close the connection on a message larger than this many bytes"`
+}
+
+type PlacementConfig struct {
+	Strategy            string `toml:"strategy" yaml:"strategy" env:"ISU_PLACEMENT" usage:"room placement (least-loaded, hash)"`
+	HeartbeatIntervalMS int    `toml:"heartbeat_interval_ms" yaml:"heartbeat_interval_ms" env:"ISU_HEARTBEAT_INTERVAL_MS" usage:"milliseconds between host heartbeats"`
+	HostTTLMS           int    `toml:"host_ttl_ms" yaml:"host_ttl_ms" env:"ISU_HOST_TTL_MS" usage:"milliseconds without heartbeat before a host is dead"`
+}
+
+// config は main で loadConfig したもの。テストではデフォルト値のまま使う
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:             ":5000",
+		PprofListen:        ":6060",
+		WebHosts:           []string{"localhost:5000"},
+		ShutdownTimeoutSec: 10,
+		DB: DBConfig{
+			Host:         "127.0.0.1",
+			Port:         3306,
+			User:         "root",
+			Name:         "isudb",
+			MaxOpenConns: 20,
+
+			ConnectTimeoutSec: 30,
+		},
+		Redis: RedisConfig{
+			URL:       "redis://localhost:6379",
+			SharedURL: "redis://localhost:6379",
+		},
+		Game: GameConfig{
+			Store:            "redis",
+			StatusIntervalMS: 500,
+			HorizonMS:        1000,
+		},
+		WebSocket: WebSocketConfig{
+			Compression:       true,
+			CompressionLevel:  flate.BestSpeed,
+			ReadBufferSize:    4096,
+			WriteBufferSize:   16384,
+			Subprotocols:      []string{"msgpack", "json"},
+			MaxProtocolErrors: 10,
+			MaxMessageSize:    65536,
+		},
+		Placement: PlacementConfig{
+			Strategy:            placementLeastLoaded,
+			HeartbeatIntervalMS: 1000,
+			HostTTLMS:           5000,
+		},
+	}
+}
+
+// configField は Config の1つの値
+type configField struct {
+	key    string // 設定ファイルのキーを . でつないだもの。フラグ名にもなる
+	env    string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+func (c *Config) fields() []configField {
+	return appendConfigFields(nil, "", reflect.ValueOf(c).Elem())
+}
+
+func appendConfigFields(fields []configField, prefix string, v reflect.Value) []configField {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + f.Tag.Get("toml")
+		if f.Type.Kind() == reflect.Struct {
+			fields = appendConfigFields(fields, key+".", v.Field(i))
+			continue
+		}
+		fields = append(fields, configField{
+			key:    key,
+			env:    f.Tag.Get("env"),
+			usage:  f.Tag.Get("usage"),
+			secret: f.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fields
+}
+
+func setConfigValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an unsigned integer", s)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := []string{}
+		for _, x := range strings.Split(s, ",") {
+			if x = strings.TrimSpace(x); x != "" {
+				list = append(list, x)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func formatConfigValue(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// configFlag は Config の値を上書きするフラグ。指定されたものだけ loadConfig で反映する
+type configFlag struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *configFlag) String() string   { return f.value }
+func (f *configFlag) IsBoolFlag() bool { return f.isBool }
+
+func (f *configFlag) Set(s string) error {
+	f.value, f.set = s, true
+	return nil
+}
+
+type configFlags map[string]*configFlag
+
+// registerConfigFlags は Config の全ての値のフラグを fs に登録する
+func registerConfigFlags(fs *flag.FlagSet) configFlags {
+	flags := configFlags{}
+	for _, f := range defaultConfig().fields() {
+		fl := &configFlag{value: formatConfigValue(f.value), isBool: f.value.Kind() == reflect.Bool}
+		usage := f.usage
+		if f.env != "" {
+			usage += " ($" + f.env + ")"
+		}
+		fs.Var(fl, f.key, usage)
+		flags[f.key] = fl
+	}
+	return flags
+}
+
+// loadConfig は設定を読み込んで検証する。path が空の場合は設定ファイルを読まない
+func loadConfig(path string, lookupEnv func(string) (string, bool), flags configFlags) (*Config, error) {
+	c := defaultConfig()
+	if path != "" {
+		err := c.readFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range c.fields() {
+		if s, ok := lookupEnv(f.env); f.env != "" && ok && s != "" {
+			err := setConfigValue(f.value, s)
+			if err != nil {
+				return nil, fmt.Errorf("$%s: %v", f.env, err)
+			}
+		}
+		if fl, ok := flags[f.key]; ok && fl.set {
+			err := setConfigValue(f.value, fl.value)
+			if err != nil {
+				return nil, fmt.Errorf("-%s: %v", f.key, err)
+			}
+		}
+	}
+
+	err := c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch filepath.Ext(path) {
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown keys %v", path, undecoded)
+		}
+	case ".yaml", ".yml":
+		err := yaml.UnmarshalStrict(data, c)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: config file must be .toml or .yaml", path)
+	}
+	return nil
+}
+
+// validate は全ての誤りをまとめて返す
+func (c *Config) validate() error {
+	problems := []string{}
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+		}
+	}
+	isAddr := func(s string) bool {
+		_, _, err := net.SplitHostPort(s)
+		return err == nil
+	}
+	isRedisURL := func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && (u.Scheme == "redis" || u.Scheme == "rediss") && u.Host != ""
+	}
+
+	check(isAddr(c.Listen), "listen", "%q is not host:port", c.Listen)
+	check(c.PprofListen == "" || isAddr(c.PprofListen), "pprof_listen", "%q is not host:port", c.PprofListen)
+	check(len(c.WebHosts) > 0, "web_hosts", "must not be empty")
+	for _, h := range c.WebHosts {
+		check(isAddr(h), "web_hosts", "%q is not host:port", h)
+	}
+	check(c.SelfHost == "" || containsString(c.WebHosts, c.SelfHost), "self_host", "%q is not in web_hosts", c.SelfHost)
+	check(c.ShutdownTimeoutSec > 0, "shutdown_timeout_sec", "must be positive")
+
+	check(c.DB.Host != "", "db.host", "must not be empty")
+	check(c.DB.Port > 0 && c.DB.Port <= 65535, "db.port", "%d is out of range", c.DB.Port)
+	check(c.DB.User != "", "db.user", "must not be empty")
+	check(c.DB.Name != "", "db.name", "must not be empty")
+	check(c.DB.MaxOpenConns > 0, "db.max_open_conns", "must be positive")
+	check(c.DB.ConnectTimeoutSec > 0, "db.connect_timeout_sec", "must be positive")
+
+	check(isRedisURL(c.Redis.URL), "redis.url", "%q is not a redis:// URL", c.Redis.URL)
+	check(isRedisURL(c.Redis.SharedURL), "redis.shared_url", "%q is not a redis:// URL", c.Redis.SharedURL)
+
+	switch c.Game.Store {
+	case "redis", "mysql", "memory":
+	default:
+		check(false, "game.store", "unknown store %q", c.Game.Store)
+	}
+	check(c.Game.StatusIntervalMS > 0, "game.status_interval_ms", "must be positive")
+	check(c.Game.HorizonMS > 0, "game.horizon_ms", "must be positive")
+
+	check(c.WebSocket.CompressionLevel >= flate.HuffmanOnly && c.WebSocket.CompressionLevel <= flate.BestCompression,
+		"websocket.compression_level", "%d is out of range", c.WebSocket.CompressionLevel)
+	check(c.WebSocket.ReadBufferSize >= 0, "websocket.read_buffer_size", "must not be negative")
+	check(c.WebSocket.WriteBufferSize >= 0, "websocket.write_buffer_size", "must not be negative")
+	for _, p := range c.WebSocket.Subprotocols {
+		check(codecByName(p) != nil, "websocket.subprotocols", "unknown subprotocol %q", p)
+	}
+	check(c.WebSocket.MaxProtocolErrors > 0, "websocket.max_protocol_errors", "must be positive")
+	check(c.WebSocket.MaxMessageSize > 0, "websocket.max_message_size", "must be positive")
+
+	switch c.Placement.Strategy {
+	case placementLeastLoaded, placementHash:
+	default:
+		check(false, "placement.strategy", "unknown strategy %q", c.Placement.Strategy)
+	}
+	check(c.Placement.HeartbeatIntervalMS > 0, "placement.heartbeat_interval_ms", "must be positive")
+	check(c.Placement.HostTTLMS > c.Placement.HeartbeatIntervalMS, "placement.host_ttl_ms", "must be longer than heartbeat_interval_ms")
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// usesDB は MySQL に接続する必要があるかどうかを返す
+func (c *Config) usesDB() bool {
+	return c.MasterItems == "" || c.Game.Store == "mysql"
+}
+
+// writeConfig は c を TOML で書き出す。パスワードなどは伏せる
+func writeConfig(w io.Writer, c *Config) error {
+	masked := *c
+	for _, f := range masked.fields() {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString("********")
+		}
+	}
+	return toml.NewEncoder(w).Encode(&masked)
+}
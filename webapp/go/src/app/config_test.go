@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "config")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	tomlPath := filepath.Join(dir, "app.toml")
+	assert.Nil(ioutil.WriteFile(tomlPath, []byte(`
+web_hosts = ["a:5000", "b:5000"]
+[db]
+host = "db-from-file"
+port = 13306
+[game]
+store = "mysql"
+`), 0644))
+
+	env := map[string]string{"ISU_DB_HOST": "db-from-env", "ISU_DB_PASSWORD": ""}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	assert.Nil(fs.Parse([]string{"-game.store", "memory", "-debug"}))
+
+	c, err := loadConfig(tomlPath, lookupEnv, flags)
+	assert.Nil(err)
+	assert.Equal([]string{"a:5000", "b:5000"}, c.WebHosts)
+	assert.Equal("db-from-env", c.DB.Host) // 環境変数はファイルより優先
+	assert.Equal(13306, c.DB.Port)
+	assert.Equal("root", c.DB.User)      // 空の環境変数は無視してデフォルト値のまま
+	assert.Equal("memory", c.Game.Store) // フラグは環境変数より優先
+	assert.True(c.Debug)
+	assert.Equal(500, c.Game.StatusIntervalMS)
+
+	yamlPath := filepath.Join(dir, "app.yaml")
+	assert.Nil(ioutil.WriteFile(yamlPath, []byte("websocket:\n  subprotocols: [json]\n  compresion: false\n"), 0644))
+	_, err = loadConfig(yamlPath, lookupEnv, nil)
+	assert.NotNil(err) // 知らないキーは誤り
+
+	env["ISU_WEB_HOSTS"] = "a:5000,nohost"
+	env["ISU_PLACEMENT"] = "random"
+	_, err = loadConfig("", lookupEnv, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `web_hosts: "nohost" is not host:port`)
+		assert.Contains(err.Error(), `placement.strategy: unknown strategy "random"`)
+	}
+}
+
+// 全ての値を環境変数とフラグのどちらからでも設定できること
+func TestConfigFieldsSettable(t *testing.T) {
+	assert := assert.New(t)
+
+	env := map[string]string{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := registerConfigFlags(fs)
+	args := []string{}
+	want := map[string]string{}
+	for _, f := range defaultConfig().fields() {
+		s := formatConfigValue(f.value)
+		want[f.key] = s
+		if f.env != "" {
+			env[f.env] = s
+		}
+		args = append(args, "-"+f.key+"="+s)
+	}
+	lookupEnv := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+
+	c, err := loadConfig("", lookupEnv, nil)
+	if assert.Nil(err) {
+		for _, f := range c.fields() {
+			assert.Equal(want[f.key], formatConfigValue(f.value), "$%s", f.env)
+		}
+	}
+
+	assert.Nil(fs.Parse(args))
+	c, err = loadConfig("", func(string) (string, bool) { return "", false }, flags)
+	if assert.Nil(err) {
+		for _, f := range c.fields() {
+			assert.Equal(want[f.key], formatConfigValue(f.value), "-%s", f.key)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	c := defaultConfig()
+	c.DB.Password = "secret"
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeConfig(&buf, c))
+	assert.NotContains(t, buf.String(), "secret")
+	assert.Equal(t, "secret", c.DB.Password)
+}
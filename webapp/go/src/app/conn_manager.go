@@ -0,0 +1,99 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 接続を閉じるときにクライアントに送る close frame の理由。どれも /room/ から接続先を取得し直してもらう
+const (
+	closeReasonRestart = "server restarting, reconnect"
+	closeReasonMoved   = "room moved, reconnect"
+	closeReasonSlow    = "too slow to receive status, reconnect"
+)
+
+var wsConns = newConnManager()
+
+// connManager は serveGameConn で処理中の websocket 接続を管理する
+type connManager struct {
+	mu       sync.Mutex
+	conns    map[*managedConn]struct{}
+	closing  bool
+	shutdown chan struct{} // 停止時に close される
+	wg       sync.WaitGroup
+}
+
+type managedConn struct {
+	ws *websocket.Conn
+}
+
+func newConnManager() *connManager {
+	return &connManager{
+		conns:    map[*managedConn]struct{}{},
+		shutdown: make(chan struct{}),
+	}
+}
+
+// serve は ws を登録して serveGameConn を開始する。停止中の場合は close frame を送って閉じる
+func (m *connManager) serve(ws *websocket.Conn, roomName string, proto wsProtocol) {
+	m.mu.Lock()
+	if m.closing {
+		m.mu.Unlock()
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, closeReasonRestart),
+			time.Now().Add(wsWriteWait))
+		ws.Close()
+		return
+	}
+	c := &managedConn{ws: ws}
+	m.conns[c] = struct{}{}
+	m.wg.Add(1)
+	m.mu.Unlock()
+
+	go func() {
+		defer m.wg.Done()
+		defer m.remove(c)
+		serveGameConn(ws, roomName, proto, m.shutdown)
+	}()
+}
+
+func (m *connManager) remove(c *managedConn) {
+	m.mu.Lock()
+	delete(m.conns, c)
+	m.mu.Unlock()
+}
+
+// closeAll は新しい接続を断り、全ての接続に close frame を送って閉じるよう伝える。
+// 処理中のアクションが終わって全ての接続が閉じるまで待つ。timeout を過ぎたら残った接続を強制的に閉じる
+func (m *connManager) closeAll(timeout time.Duration) {
+	m.mu.Lock()
+	if !m.closing {
+		m.closing = true
+		close(m.shutdown)
+	}
+	log.Println("closing", len(m.conns), "connections")
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	m.mu.Lock()
+	log.Println("force closing", len(m.conns), "connections")
+	for c := range m.conns {
+		c.ws.Close()
+	}
+	m.mu.Unlock()
+	<-done
+}
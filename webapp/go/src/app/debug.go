@@ -1,5 +0,0 @@
-package main
-
-import "os"
-
-var debug = os.Getenv("DEBUG") == "1"
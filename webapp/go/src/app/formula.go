@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// アイテムの power, price を購入回数 x から求める式。
+// マスタのアイテムごとに power_formula, price_formula で kind とパラメータを指定する。
+// 指定しない場合は今までどおり power1..4, price1..4 を係数にした (cx+1)*d^(ax+b) を使う
+//
+//	exponential: (cx+1)*d^(ax+b)。係数は power1..4, price1..4
+//	linear:      coef[0] + coef[1]*x
+//	polynomial:  coef[0] + coef[1]*x + coef[2]*x^2 + ...
+//	piecewise:   from が x 以下の最後の step の value。x が最初の from より小さい場合は最初の value
+//	multiplier:  factor * (アイテム item の power(x))
+//
+// linear と polynomial の coef はどちらも定数項から順に書く
+const (
+	formulaExponential = "exponential"
+	formulaLinear      = "linear"
+	formulaPolynomial  = "polynomial"
+	formulaPiecewise   = "piecewise"
+	formulaMultiplier  = "multiplier"
+)
+
+// Formula は購入回数 x に対する power または price
+type Formula interface {
+	// At は x 回目の値を返す。x は 0 以上
+	At(x int) *big.Int
+}
+
+// FormulaSpec はマスタに書く式の種類とパラメータ
+type FormulaSpec struct {
+	Kind   string        `json:"kind" yaml:"kind"`
+	Coef   []int64       `json:"coef,omitempty" yaml:"coef,omitempty"`
+	Steps  []FormulaStep `json:"steps,omitempty" yaml:"steps,omitempty"`
+	Item   int           `json:"item,omitempty" yaml:"item,omitempty"`
+	Factor int64         `json:"factor,omitempty" yaml:"factor,omitempty"`
+}
+
+type FormulaStep struct {
+	From  int   `json:"from" yaml:"from"`
+	Value int64 `json:"value" yaml:"value"`
+}
+
+func (spec *FormulaSpec) kind() string {
+	if spec == nil || spec.Kind == "" {
+		return formulaExponential
+	}
+	return spec.Kind
+}
+
+type expFormula struct {
+	a, b, c, d int64
+}
+
+func (f *expFormula) At(x int) *big.Int {
+	n := int64(x)
+	s := big.NewInt(f.c*n + 1)
+	return s.Mul(s, new(big.Int).Exp(big.NewInt(f.d), big.NewInt(f.a*n+f.b), nil))
+}
+
+type polynomialFormula struct {
+	coef []int64 // coef[i] は x^i の係数
+}
+
+func (f *polynomialFormula) At(x int) *big.Int {
+	// ホーナー法
+	v := new(big.Int)
+	bx := big.NewInt(int64(x))
+	for i := len(f.coef) - 1; i >= 0; i-- {
+		v.Mul(v, bx)
+		v.Add(v, big.NewInt(f.coef[i]))
+	}
+	return v
+}
+
+type piecewiseFormula struct {
+	steps []FormulaStep
+}
+
+func (f *piecewiseFormula) At(x int) *big.Int {
+	v := f.steps[0].Value
+	for _, s := range f.steps {
+		if s.From > x {
+			break
+		}
+		v = s.Value
+	}
+	return big.NewInt(v)
+}
+
+type multiplierFormula struct {
+	target *mItem
+	factor int64
+}
+
+func (f *multiplierFormula) At(x int) *big.Int {
+	return new(big.Int).Mul(f.target.GetPower(x), big.NewInt(f.factor))
+}
+
+// newFormula は spec から式を作る。exponential の場合は a, b, c, d を係数にする。
+// multiplier の対象は items から探す
+func newFormula(spec *FormulaSpec, a, b, c, d int64, items map[int]*mItem) (Formula, error) {
+	switch spec.kind() {
+	case formulaExponential:
+		return &expFormula{a, b, c, d}, nil
+	case formulaLinear:
+		// 1次の polynomial と同じ
+		if len(spec.Coef) != 2 {
+			return nil, fmt.Errorf("linear needs 2 coef")
+		}
+		return &polynomialFormula{spec.Coef}, nil
+	case formulaPolynomial:
+		if len(spec.Coef) == 0 {
+			return nil, fmt.Errorf("polynomial needs coef")
+		}
+		return &polynomialFormula{spec.Coef}, nil
+	case formulaPiecewise:
+		if len(spec.Steps) == 0 {
+			return nil, fmt.Errorf("piecewise needs steps")
+		}
+		return &piecewiseFormula{spec.Steps}, nil
+	case formulaMultiplier:
+		target, ok := items[spec.Item]
+		if !ok {
+			return nil, fmt.Errorf("multiplier target item %d does not exist", spec.Item)
+		}
+		return &multiplierFormula{target, spec.Factor}, nil
+	}
+	return nil, fmt.Errorf("unknown formula kind %q", spec.Kind)
+}
+
+// linkFormulas はマスタの全てのアイテムの式を作る。マスタを使い始める前に1度だけ呼ぶこと
+func linkFormulas(items map[int]*mItem) error {
+	for _, m := range items {
+		power, err := newFormula(m.PowerFormula, m.Power1, m.Power2, m.Power3, m.Power4, items)
+		if err != nil {
+			return fmt.Errorf("item %d: power: %v", m.ItemID, err)
+		}
+		price, err := newFormula(m.PriceFormula, m.Price1, m.Price2, m.Price3, m.Price4, items)
+		if err != nil {
+			return fmt.Errorf("item %d: price: %v", m.ItemID, err)
+		}
+		m.power, m.price = power, price
+	}
+	return nil
+}
+
+// formulaProblems は式の誤りを返す。値が負にならないこと、
+// exponential の場合は購入回数 x が catalogMaxCount まで cx+1 と ax+b が int64 に収まること、
+// multiplier の場合は対象が power で循環しないことを確かめる
+func formulaProblems(m *mItem, name string, spec *FormulaSpec, a, b, c, d int64, items map[int]*mItem) []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("item %d: %s ", m.ItemID, name)+fmt.Sprintf(format, args...))
+	}
+
+	_, err := newFormula(spec, a, b, c, d, items)
+	if err != nil {
+		add("%v", err)
+		return problems
+	}
+	switch spec.kind() {
+	case formulaExponential:
+		if d <= 0 {
+			add("base %d is not positive", d)
+		}
+		if a < 0 || b < 0 || c < 0 {
+			add("coefficients must not be negative")
+			break
+		}
+		if c > (math.MaxInt64-1)/catalogMaxCount || a > (math.MaxInt64-b)/catalogMaxCount {
+			add("overflows int64 within %d purchases", catalogMaxCount)
+		}
+	case formulaLinear, formulaPolynomial:
+		for _, x := range spec.Coef {
+			if x < 0 {
+				add("coefficients must not be negative")
+				break
+			}
+		}
+	case formulaPiecewise:
+		for i, s := range spec.Steps {
+			if s.Value < 0 {
+				add("step %d value must not be negative", i)
+			}
+			if i > 0 && s.From <= spec.Steps[i-1].From {
+				add("step %d from must be increasing", i)
+			}
+		}
+	case formulaMultiplier:
+		if spec.Factor < 0 {
+			add("factor must not be negative")
+		}
+		// 対象の power をたどって自分の power に戻らないこと
+		seen := map[int]bool{}
+		for t := items[spec.Item]; t != nil; t = items[t.PowerFormula.Item] {
+			if (name == "power" && t == m) || seen[t.ItemID] {
+				add("multiplier refers to itself")
+				break
+			}
+			seen[t.ItemID] = true
+			if t.PowerFormula.kind() != formulaMultiplier {
+				break
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormula(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "formula")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.yaml")
+	assert.Nil(ioutil.WriteFile(path, []byte(`
+- {item_id: 1, power1: 1, power2: 2, power3: 2, power4: 3, price1: 5, price2: 4, price3: 3, price4: 2}
+- item_id: 2
+  power_formula: {kind: linear, coef: [10, 3]}
+  price_formula: {kind: polynomial, coef: [1, 0, 2]}
+- item_id: 3
+  power_formula: {kind: piecewise, steps: [{from: 1, value: 5}, {from: 3, value: 50}]}
+  price_formula: {kind: multiplier, item: 1, factor: 10}
+`), 0644))
+	list, err := loadMasterItemsFile(path)
+	assert.Nil(err)
+	items, err := masterItemsByID(list)
+	assert.Nil(err)
+	assert.Nil(validateCatalog(items, nil))
+	assert.Nil(linkFormulas(items))
+
+	equal := func(want int64, got *big.Int) {
+		assert.Equal(0, big.NewInt(want).Cmp(got), "want %d, got %s", want, got)
+	}
+	// 指定しない場合は今までと同じ
+	equal(81, items[1].GetPower(1))
+	equal(2048, items[1].GetPrice(1))
+	equal(16, items[2].GetPower(2))
+	equal(19, items[2].GetPrice(3))
+	equal(5, items[3].GetPower(2))
+	equal(50, items[3].GetPower(4))
+	equal(810, items[3].GetPrice(1))
+	equal(50, items[3].GetPower(3))
+
+	// CSV でも JSON で指定できる
+	path = filepath.Join(dir, "items.csv")
+	assert.Nil(ioutil.WriteFile(path, []byte(`item_id,power1,power2,power3,power4,price1,price2,price3,price4,power_formula
+2,0,0,0,0,0,0,0,0,"{""kind"": ""linear"", ""coef"": [10, 3]}"
+`), 0644))
+	list, err = loadMasterItemsFile(path)
+	assert.Nil(err)
+	assert.Equal(items[2].PowerFormula, list[0].PowerFormula)
+}
+
+func TestValidateFormula(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := &FormulaSpec{Kind: formulaLinear, Coef: []int64{1, 1}}
+	item := func(id int, power *FormulaSpec) *mItem {
+		return &mItem{ItemID: id, PowerFormula: power, PriceFormula: ok}
+	}
+	err := validateCatalog(map[int]*mItem{
+		1:  item(1, &FormulaSpec{Kind: "cubic"}),
+		2:  item(2, &FormulaSpec{Kind: formulaLinear, Coef: []int64{1}}),
+		3:  item(3, &FormulaSpec{Kind: formulaPolynomial, Coef: []int64{1, -1}}),
+		4:  item(4, &FormulaSpec{Kind: formulaPiecewise, Steps: []FormulaStep{{From: 2, Value: 1}, {From: 2, Value: 3}}}),
+		5:  item(5, &FormulaSpec{Kind: formulaMultiplier, Item: 9, Factor: 2}),
+		6:  item(6, &FormulaSpec{Kind: formulaMultiplier, Item: 7, Factor: 2}),
+		7:  item(7, &FormulaSpec{Kind: formulaMultiplier, Item: 6, Factor: 2}),
+		8:  item(8, &FormulaSpec{Kind: formulaMultiplier, Item: 10, Factor: -1}),
+		10: item(10, ok),
+	}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), `item 1: power unknown formula kind "cubic"`)
+		assert.Contains(err.Error(), "item 2: power linear needs 2 coef")
+		assert.Contains(err.Error(), "item 3: power coefficients must not be negative")
+		assert.Contains(err.Error(), "item 4: power step 1 from must be increasing")
+		assert.Contains(err.Error(), "item 5: power multiplier target item 9 does not exist")
+		assert.Contains(err.Error(), "item 6: power multiplier refers to itself")
+		assert.Contains(err.Error(), "item 7: power multiplier refers to itself")
+		assert.Contains(err.Error(), "item 8: power factor must not be negative")
+		assert.NotContains(err.Error(), "item 10")
+	}
+
+	// 自分の power を price に使うのは循環しない
+	assert.Nil(validateCatalog(map[int]*mItem{
+		1: {ItemID: 1, PowerFormula: ok, PriceFormula: &FormulaSpec{Kind: formulaMultiplier, Item: 1, Factor: 3}},
+	}, nil))
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"math/big"
-	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/websocket"
 )
 
+var (
+	wsWriteWait  = 10 * time.Second    // 1回の書き込みにかけられる時間
+	wsPongWait   = 60 * time.Second    // この時間何も読めなければ切断されたとみなす
+	wsPingPeriod = wsPongWait * 9 / 10 // ping を送る間隔。wsPongWait より短くする
+)
+
 type GameRequest struct {
 	RequestID int    `json:"request_id"`
 	Action    string `json:"action"`
@@ -26,9 +30,48 @@ type GameRequest struct {
 	CountBought int `json:"count_bought"`
 }
 
+// gameMessage は websocket から読んだ GameRequest
+type gameMessage struct {
+	req GameRequest
+	err error // GameRequest として読めなかった場合の理由
+}
+
+// parseGameMessage はメッセージを GameRequest として読む。
+// 読めなかった場合も可能なら request_id だけは読み取る
+func parseGameMessage(codec wsCodec, data []byte) gameMessage {
+	req := GameRequest{}
+	err := codec.unmarshal(data, &req)
+	if err == nil {
+		return gameMessage{req: req}
+	}
+
+	var id struct {
+		RequestID int `json:"request_id"`
+	}
+	codec.unmarshal(data, &id)
+	return gameMessage{req: GameRequest{RequestID: id.RequestID}, err: ErrMalformedRequest}
+}
+
 type GameResponse struct {
 	RequestID int  `json:"request_id"`
 	IsSuccess bool `json:"is_success"`
+
+	// 失敗した場合の理由
+	ErrorCode string `json:"error_code,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+func newGameResponse(requestID int, err error) GameResponse {
+	if err == nil {
+		return GameResponse{RequestID: requestID, IsSuccess: true}
+	}
+	gerr := toGameError(err)
+	return GameResponse{
+		RequestID: requestID,
+		IsSuccess: false,
+		ErrorCode: gerr.Code,
+		Message:   gerr.Message,
+	}
 }
 
 // 10進数の指数表記に使うデータ。JSONでは [仮数部, 指数部] という2要素配列になる。
@@ -42,6 +85,12 @@ func (n Exponential) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("[%d,%d]", n.Mantissa, n.Exponent)), nil
 }
 
+func (n Exponential) appendMsgpack(b []byte) []byte {
+	b = appendMsgpackArrayHeader(b, 2)
+	b = appendMsgpackInt(b, n.Mantissa)
+	return appendMsgpackInt(b, n.Exponent)
+}
+
 type Schedule struct {
 	Time       int64       `json:"time"`
 	MilliIsu   Exponential `json:"milli_isu"`
@@ -77,530 +126,410 @@ type GameStatus struct {
 }
 
 type mItem struct {
-	ItemID int   `db:"item_id"`
-	Power1 int64 `db:"power1"`
-	Power2 int64 `db:"power2"`
-	Power3 int64 `db:"power3"`
-	Power4 int64 `db:"power4"`
-	Price1 int64 `db:"price1"`
-	Price2 int64 `db:"price2"`
-	Price3 int64 `db:"price3"`
-	Price4 int64 `db:"price4"`
+	ItemID int   `db:"item_id" json:"item_id" yaml:"item_id"`
+	Power1 int64 `db:"power1" json:"power1" yaml:"power1"`
+	Power2 int64 `db:"power2" json:"power2" yaml:"power2"`
+	Power3 int64 `db:"power3" json:"power3" yaml:"power3"`
+	Power4 int64 `db:"power4" json:"power4" yaml:"power4"`
+	Price1 int64 `db:"price1" json:"price1" yaml:"price1"`
+	Price2 int64 `db:"price2" json:"price2" yaml:"price2"`
+	Price3 int64 `db:"price3" json:"price3" yaml:"price3"`
+	Price4 int64 `db:"price4" json:"price4" yaml:"price4"`
+
+	// 空の場合は power1..4, price1..4 の (cx+1)*d^(ax+b)。formula.go を参照
+	PowerFormula *FormulaSpec `db:"-" json:"power_formula,omitempty" yaml:"power_formula,omitempty"`
+	PriceFormula *FormulaSpec `db:"-" json:"price_formula,omitempty" yaml:"price_formula,omitempty"`
+	// 建てると他のアイテムの power を倍にする。synergy.go を参照
+	Synergy *SynergySpec `db:"-" json:"synergy,omitempty" yaml:"synergy,omitempty"`
+
+	power, price Formula // linkFormulas で作る
+
+	// 計算済みの power, price。マスタは作った後に変更しないので捨てなくてよい
+	powerTable itemTable
+	priceTable itemTable
 }
 
+func (item *mItem) powerFormula() Formula {
+	if item.power == nil {
+		return &expFormula{item.Power1, item.Power2, item.Power3, item.Power4}
+	}
+	return item.power
+}
+
+func (item *mItem) priceFormula() Formula {
+	if item.price == nil {
+		return &expFormula{item.Price1, item.Price2, item.Price3, item.Price4}
+	}
+	return item.price
+}
+
+// GetPower, GetPrice, TotalPrice が返す値は表と共有しているので変更しないこと
+
 func (item *mItem) GetPower(count int) *big.Int {
-	// power(x):=(cx+1)*d^(ax+b)
-	a := item.Power1
-	b := item.Power2
-	c := item.Power3
-	d := item.Power4
-	x := int64(count)
-
-	s := big.NewInt(c*x + 1)
-	t := new(big.Int).Exp(big.NewInt(d), big.NewInt(a*x+b), nil)
-	return new(big.Int).Mul(s, t)
+	v, _ := item.powerTable.get(item.powerFormula(), count)
+	return v
 }
 
 func (item *mItem) GetPrice(count int) *big.Int {
-	// price(x):=(cx+1)*d^(ax+b)
-	a := item.Price1
-	b := item.Price2
-	c := item.Price3
-	d := item.Price4
-	x := int64(count)
-
-	s := big.NewInt(c*x + 1)
-	t := new(big.Int).Exp(big.NewInt(d), big.NewInt(a*x+b), nil)
-	return new(big.Int).Mul(s, t)
+	v, _ := item.priceTable.get(item.priceFormula(), count)
+	return v
 }
 
-func addIsu(roomName string, reqIsu *big.Int, reqTime int64) bool {
-	muxByRoomNameMu.Lock()
-	mu := muxByRoomName[roomName]
-	muxByRoomNameMu.Unlock()
-	mu.Lock()
-	defer mu.Unlock()
+// TotalPrice は price(1) + ... + price(count)、つまり count 個買うのに使った isu を返す
+func (item *mItem) TotalPrice(count int) *big.Int {
+	_, sum := item.priceTable.get(item.priceFormula(), count)
+	return sum
+}
 
-	_, ok := updateRoomTime(nil, roomName, reqTime)
-	if !ok {
-		return false
+// addIsu, buyItem, getStatus は部屋の goroutine から呼ぶ
+
+func addIsu(room *gameRoom, reqIsu *big.Int, reqTime int64) error {
+	if room.frozen {
+		return ErrRoomMoved
+	}
+	roomName := room.name
+	currentTime, err := updateRoomTime(room, reqTime)
+	if err != nil {
+		return err
 	}
 
-	a := &Adding{RoomName: roomName, Time: reqTime}
-	err := addingStore.Get(a)
+	state, err := room.getState(currentTime)
 	if err != nil {
-		a.Isu = "0"
-	}
-	//
-	// _, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, '0') ON DUPLICATE KEY UPDATE isu=isu", roomName, reqTime)
-	// if err != nil {
-	//   log.Println(err)
-	//   tx.Rollback()
-	//   return false
-	// }
-	//
-	// var isuStr string
-	// err = tx.QueryRow("SELECT isu FROM adding WHERE room_name = ? AND time = ? FOR UPDATE", roomName, reqTime).Scan(&isuStr)
-	// if err != nil {
-	//   log.Println(err)
-	//   tx.Rollback()
-	//   return false
-	// }
-	isu := str2big(a.Isu)
-
-	isu.Add(isu, reqIsu)
-	a.Isu = isu.String()
-	err = addingStore.Set(a)
+		return err
+	}
+
+	err = gameStore.AddAdding(roomName, reqTime, reqIsu)
 	if err != nil {
-		log.Println(err)
-		return false
-	}
-	// _, err = tx.Exec("UPDATE adding SET isu = ? WHERE room_name = ? AND time = ?", isu.String(), roomName, reqTime)
-	// if err != nil {
-	//   log.Println(err)
-	//   tx.Rollback()
-	//   return false
-	// }
-	//
-	// if err := tx.Commit(); err != nil {
-	//   log.Println(err)
-	//   return false
-	// }
-	return true
+		return err
+	}
+	state.addAdding(reqTime, reqIsu)
+	return nil
 }
 
-func buyItem(roomName string, itemID int, countBought int, reqTime int64) bool {
-	muxByRoomNameMu.Lock()
-	mu := muxByRoomName[roomName]
-	muxByRoomNameMu.Unlock()
-	mu.Lock()
-	defer mu.Unlock()
-
-	// tx, err := db.Beginx()
-	// if err != nil {
-	//   log.Println(err)
-	//   return false
-	// }
-
-	_, ok := updateRoomTime(nil, roomName, reqTime)
-	if !ok {
-		// tx.Rollback()
-		return false
+func buyItem(room *gameRoom, itemID int, countBought int, reqTime int64) error {
+	if room.frozen {
+		return ErrRoomMoved
 	}
-
-	countBuying, err := buyingStore.Count(buyingStore.Query(fmt.Sprintf("%s:item_id", roomName)).Eq(itemID))
-	// var countBuying int
-	// err = tx.Get(&countBuying, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ?", roomName, itemID)
+	roomName := room.name
+	currentTime, err := updateRoomTime(room, reqTime)
 	if err != nil {
-		log.Println(err)
-		// tx.Rollback()
-		return false
-	}
-	if countBuying != countBought {
-		// tx.Rollback()
-		log.Println(roomName, itemID, countBought+1, " is already bought")
-		return false
+		return err
 	}
 
-	var addings []*Adding
-	err = addingStore.Select(&addings, addingStore.Query(fmt.Sprintf("%s:time", roomName)).LtEq(reqTime))
-	// err = tx.Select(&addings, "SELECT isu FROM adding WHERE room_name = ? AND time <= ?", roomName, reqTime)
+	state, err := room.getState(currentTime)
 	if err != nil {
-		log.Println(err)
-		// tx.Rollback()
-		return false
+		return err
 	}
 
-	totalMilliIsu := new(big.Int)
-	for _, a := range addings {
-		totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), bi1000))
+	// 読み込んだ状態と同じバージョンのマスタを使う
+	var item *mItem = state.mItems[itemID]
+	if item == nil {
+		return ErrUnknownItem
 	}
 
-	var buyings []*Buying
-	err = buyingStore.Select(&buyings, buyingStore.Query(fmt.Sprintf("%s:time", roomName)))
-	// err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
-	if err != nil {
-		log.Println(err)
-		// tx.Rollback()
-		return false
-	}
-	for _, b := range buyings {
-		var item *mItem = MasterItems[b.ItemID]
-		cost := new(big.Int).Mul(item.GetPrice(b.Ordinal), bi1000)
-		totalMilliIsu.Sub(totalMilliIsu, cost)
-		if b.Time <= reqTime {
-			gain := new(big.Int).Mul(item.GetPower(b.Ordinal), big.NewInt(reqTime-b.Time))
-			totalMilliIsu.Add(totalMilliIsu, gain)
-		}
+	if state.itemBought[itemID] != countBought {
+		return ErrAlreadyBought
 	}
 
-	var item *mItem = MasterItems[itemID]
 	need := new(big.Int).Mul(item.GetPrice(countBought+1), bi1000)
-	if totalMilliIsu.Cmp(need) < 0 {
-		log.Println("not enough")
-		// tx.Rollback()
-		return false
+	if state.milliIsuAt(reqTime).Cmp(need) < 0 {
+		return ErrNotEnough
 	}
 
-	err = buyingStore.Set(&Buying{
+	b := &Buying{
 		RoomName: roomName,
 		ItemID:   itemID,
 		Ordinal:  countBought + 1,
 		Time:     reqTime,
-	})
-	// _, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, itemID, countBought+1, reqTime)
+	}
+	err = gameStore.AddBuying(b)
+	if err == ErrOrdinalTaken {
+		// 別のホストで購入された。次回は gameStore から読み直す
+		room.state = nil
+		return ErrAlreadyBought
+	}
 	if err != nil {
-		log.Println(err)
-		// tx.Rollback()
-		return false
+		return err
 	}
+	state.addBuying(b)
 
-	// if err := tx.Commit(); err != nil {
-	//   log.Println(err)
-	//   return false
-	// }
-
-	return true
+	return nil
 }
 
-func getStatus(roomName string) (*GameStatus, error) {
-	muxByRoomNameMu.Lock()
-	mu := muxByRoomName[roomName]
-	muxByRoomNameMu.Unlock()
-	mu.Lock()
-	defer mu.Unlock()
-
-	tx, err := db.Beginx()
+func getStatus(room *gameRoom) (*GameStatus, error) {
+	roomName := room.name
+	currentTime, err := currentRoomTime(room, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	currentTime, ok := updateRoomTime(tx, roomName, 0)
-	if !ok {
-		tx.Rollback()
-		return nil, fmt.Errorf("updateRoomTime failure")
-	}
-
-	mItems := MasterItems
-
-	addings := []*Adding{}
-	err = addingStore.Select(&addings, addingStore.Query(fmt.Sprintf("%s:time", roomName)))
-	// err = tx.Select(&addings, "SELECT time, isu FROM adding WHERE room_name = ?", roomName)
+	state, err := room.getState(currentTime)
 	if err != nil {
-		tx.Rollback()
 		return nil, err
 	}
-	deletableTimes := []int64{}
-	var totalIsu = big.NewInt(0)
-	newAddings := []*Adding{{RoomName: roomName, Time: currentTime, Isu: totalIsu.String()}}
-	for _, a := range addings {
-		// adding は adding.time に isu を増加させる
-		if a.Time <= currentTime {
-			totalIsu.Add(totalIsu, str2big(a.Isu))
-			deletableTimes = append(deletableTimes, a.Time)
-		} else {
-			newAddings = append(newAddings, a)
+	state.advance(currentTime)
+
+	if state.addingDirty {
+		// currentTime までの adding を1つにまとめる。まとめた後は currentTime より前に戻れないので時刻も書き込む
+		err = saveRoomTime(room, currentTime)
+		if err != nil {
+			return nil, err
 		}
-	}
-	newAddings[0].Isu = totalIsu.String()
-	if len(deletableTimes) > 0 {
-		addingStore.RemoveBy(addingStore.Query(fmt.Sprintf("%s:time", roomName)).LtEq(currentTime))
-		// query, args, err := sqlx.In("DELETE FROM adding WHERE room_name = ? AND time in (?)", roomName, deletableTimes)
-		// if err != nil {
-		//   tx.Rollback()
-		//   return nil, err
-		// }
-		// _, err = tx.Exec(query, args...)
+		err = gameStore.CompactAddings(roomName, currentTime, state.totalIsu)
 		if err != nil {
-			tx.Rollback()
 			return nil, err
 		}
-	}
-	err = addingStore.Set(newAddings[0])
-	// _, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE isu=isu", roomName, currentTime, totalIsu.String())
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-
-	buyings := []*Buying{}
-	err = buyingStore.Select(&buyings, buyingStore.Query(fmt.Sprintf("%s:time", roomName)))
-	// err = tx.Select(&buyings, "SELECT item_id, ordinal, time FROM buying WHERE room_name = ?", roomName)
-	if err != nil {
-		tx.Rollback()
-		return nil, err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return nil, err
+		state.addingDirty = false
 	}
 
-	status, err := calcStatus(currentTime, mItems, newAddings, buyings)
+	status, err := state.calcStatus()
 	if err != nil {
 		return nil, err
 	}
 
 	// calcStatusに時間がかかる可能性があるので タイムスタンプを取得し直す
 
-	status.Time = int64(time.Now().UnixNano()) / 1000000
+	status.Time = nowMilli()
 	return status, err
 }
 
 func calcStatus(currentTime int64, mItems map[int]*mItem, addings []*Adding, buyings []*Buying) (*GameStatus, error) {
-	var (
-		// 1ミリ秒に生産できる椅子の単位をミリ椅子とする
-		totalMilliIsu = big.NewInt(0)
-		totalPower    = big.NewInt(0)
-
-		itemPower    = map[int]*big.Int{}    // ItemID => Power
-		itemPrice    = map[int]*big.Int{}    // ItemID => Price
-		itemOnSale   = map[int]int64{}       // ItemID => OnSale
-		itemBuilt    = map[int]int{}         // ItemID => BuiltCount
-		itemBought   = map[int]int{}         // ItemID => CountBought
-		itemBuilding = map[int][]Building{}  // ItemID => Buildings
-		itemPower0   = map[int]Exponential{} // ItemID => currentTime における Power
-		itemBuilt0   = map[int]int{}         // ItemID => currentTime における BuiltCount
-
-		addingAt = map[int64]*Adding{}   // Time => currentTime より先の Adding
-		buyingAt = map[int64][]*Buying{} // Time => currentTime より先の Buying
-	)
-
-	for itemID := range mItems {
-		itemPower[itemID] = big.NewInt(0)
-		itemBuilding[itemID] = []Building{}
-	}
-
+	s := newRoomState("", mItems, currentTime)
 	for _, a := range addings {
-		// adding は adding.time に isu を増加させる
-		if a.Time <= currentTime {
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), bi1000))
-		} else {
-			addingAt[a.Time] = a
-		}
-	}
-
-	for _, b := range buyings {
-		// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
-		itemBought[b.ItemID]++
-		m := mItems[b.ItemID]
-		totalMilliIsu.Sub(totalMilliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), bi1000))
-
-		if b.Time <= currentTime {
-			itemBuilt[b.ItemID]++
-			power := m.GetPower(itemBought[b.ItemID])
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(power, big.NewInt(currentTime-b.Time)))
-			totalPower.Add(totalPower, power)
-			itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-		} else {
-			buyingAt[b.Time] = append(buyingAt[b.Time], b)
-		}
-	}
-
-	for _, m := range mItems {
-		itemPower0[m.ItemID] = big2exp(itemPower[m.ItemID])
-		itemBuilt0[m.ItemID] = itemBuilt[m.ItemID]
-		price := m.GetPrice(itemBought[m.ItemID] + 1)
-		itemPrice[m.ItemID] = price
-		if 0 <= totalMilliIsu.Cmp(new(big.Int).Mul(price, bi1000)) {
-			itemOnSale[m.ItemID] = 0 // 0 は 時刻 currentTime で購入可能であることを表す
-		}
-	}
-
-	schedule := []Schedule{
-		Schedule{
-			Time:       currentTime,
-			MilliIsu:   big2exp(totalMilliIsu),
-			TotalPower: big2exp(totalPower),
-		},
-	}
-
-	// currentTime から 1000 ミリ秒先までシミュレーションする
-	for t := currentTime + 1; t <= currentTime+1000; t++ {
-		totalMilliIsu.Add(totalMilliIsu, totalPower)
-		updated := false
-
-		// 時刻 t で発生する adding を計算する
-		if a, ok := addingAt[t]; ok {
-			updated = true
-			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(str2big(a.Isu), bi1000))
-		}
-
-		// 時刻 t で発生する buying を計算する
-		if _, ok := buyingAt[t]; ok {
-			updated = true
-			updatedID := map[int]bool{}
-			for _, b := range buyingAt[t] {
-				m := mItems[b.ItemID]
-				updatedID[b.ItemID] = true
-				itemBuilt[b.ItemID]++
-				power := m.GetPower(b.Ordinal)
-				itemPower[b.ItemID].Add(itemPower[b.ItemID], power)
-				totalPower.Add(totalPower, power)
-			}
-			for id := range updatedID {
-				itemBuilding[id] = append(itemBuilding[id], Building{
-					Time:       t,
-					CountBuilt: itemBuilt[id],
-					Power:      big2exp(itemPower[id]),
-				})
-			}
-		}
-
-		if updated {
-			schedule = append(schedule, Schedule{
-				Time:       t,
-				MilliIsu:   big2exp(totalMilliIsu),
-				TotalPower: big2exp(totalPower),
-			})
-		}
-
-		// 時刻 t で購入可能になったアイテムを記録する
-		for itemID := range mItems {
-			if _, ok := itemOnSale[itemID]; ok {
-				continue
-			}
-			if 0 <= totalMilliIsu.Cmp(new(big.Int).Mul(itemPrice[itemID], bi1000)) {
-				itemOnSale[itemID] = t
-			}
-		}
-	}
-
-	gsAdding := []*Adding{}
-	for _, a := range addingAt {
-		gsAdding = append(gsAdding, a)
-	}
-
-	gsItems := []Item{}
-	for itemID, _ := range mItems {
-		gsItems = append(gsItems, Item{
-			ItemID:      itemID,
-			CountBought: itemBought[itemID],
-			CountBuilt:  itemBuilt0[itemID],
-			NextPrice:   big2exp(itemPrice[itemID]),
-			Power:       itemPower0[itemID],
-			Building:    itemBuilding[itemID],
-		})
-	}
-
-	gsOnSale := []OnSale{}
-	for itemID, t := range itemOnSale {
-		gsOnSale = append(gsOnSale, OnSale{
-			ItemID: itemID,
-			Time:   t,
-		})
+		s.addAdding(a.Time, str2big(a.Isu))
 	}
+	s.addBuyings(buyings)
+	return s.calcStatus()
+}
 
-	return &GameStatus{
-		Adding:   gsAdding,
-		Schedule: schedule,
-		Items:    gsItems,
-		OnSale:   gsOnSale,
-	}, nil
+// wsProtocol は接続ごとにクライアントが選んだプロトコル
+type wsProtocol struct {
+	delta bool // GameStatus を StatusSnapshot と StatusDelta で送る
+	codec wsCodec
 }
 
-func serveGameConn(ws *websocket.Conn, roomName string) {
+// serveGameConn は接続が閉じるか shutdown が close されるまで ws を処理する
+func serveGameConn(ws *websocket.Conn, roomName string, proto wsProtocol, shutdown <-chan struct{}) {
 	log.Println(ws.RemoteAddr(), "serveGameConn", roomName)
 	defer ws.Close()
 
-	muxByRoomNameMu.Lock()
-	if _, ok := muxByRoomName[roomName]; !ok {
-		muxByRoomName[roomName] = new(sync.Mutex)
+	// どのように接続が終わっても必ず人数を戻す
+	memberHost := addMemberToRoom(roomName)
+	defer leaveMemberToRoom(memberHost)
+
+	room := joinGameRoom(roomName)
+	defer room.leave()
+
+	closeMoved := func() {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, closeReasonMoved),
+			time.Now().Add(wsWriteWait))
 	}
-	muxByRoomNameMu.Unlock()
 
-	status, err := getStatus(roomName)
+	// 移した部屋の frozen はメモリにしか無いので、部屋を読み込み直した後や再起動した後に
+	// 古い接続先に繋ぎ直されても受け付けないよう host:room を確かめる。
+	// 部屋に参加してから確かめるので、この後に移された場合は subscribe が ErrRoomMoved を返す
+	hosted, err := isRoomHostedHere(roomName)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if !hosted {
+		log.Println(roomName, "is hosted by another host")
+		closeMoved()
+		return
+	}
+	closeSlow := func() {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, closeReasonSlow),
+			time.Now().Add(wsWriteWait))
+	}
 
-	err = ws.WriteJSON(status)
+	sub, err := room.subscribe(proto)
 	if err != nil {
 		log.Println(err)
+		if err == ErrRoomMoved {
+			closeMoved()
+		}
 		return
 	}
+	defer room.unsubscribe(sub)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	chReq := make(chan GameRequest)
+	chReq := make(chan gameMessage)
+
+	// 大きすぎるメッセージは読まずに接続を閉じる
+	ws.SetReadLimit(config.WebSocket.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
 
 	go func() {
 		defer cancel()
 		for {
-			req := GameRequest{}
-			err := ws.ReadJSON(&req)
+			_, data, err := ws.ReadMessage()
 			if err != nil {
 				log.Println(err)
-				if err == io.EOF {
-					leaveMemberToRoom(roomName)
-				}
 				return
 			}
+			ws.SetReadDeadline(time.Now().Add(wsPongWait))
 
 			select {
-			case chReq <- req:
+			case chReq <- parseGameMessage(proto.codec, data):
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
 
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
+	write := func(msg []byte) error {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return ws.WriteMessage(proto.codec.messageType(), msg)
+	}
+	writePrepared := func(msg *websocket.PreparedMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+		return ws.WritePreparedMessage(msg)
+	}
+
+	// 部屋から届いた GameStatus を書き出す
+	flush := func() error {
+		for {
+			select {
+			case msg := <-sub.ch:
+				err := writePrepared(msg)
+				if err != nil {
+					return err
+				}
+			default:
+				return nil
+			}
+		}
+	}
+
+	pingTicker := time.NewTicker(wsPingPeriod)
+	defer pingTicker.Stop()
 
+	protocolErrors := 0
 	for {
 		select {
-		case req := <-chReq:
+		case msg := <-chReq:
+			req := msg.req
 			log.Println(req)
 
-			success := false
-			switch req.Action {
-			case "addIsu":
-				success = addIsu(roomName, str2big(req.Isu), req.Time)
-			case "buyItem":
-				success = buyItem(roomName, req.ItemID, req.CountBought, req.Time)
-			default:
-				log.Println("Invalid Action")
-				return
-			}
-
-			if success {
-				// GameResponse を返却する前に 反映済みの GameStatus を返す
-				status, err := getStatus(roomName)
-				if err != nil {
-					log.Println(err)
-					return
+			err := msg.err
+			if err == nil {
+				switch req.Action {
+				case "addIsu":
+					isu, ok := new(big.Int).SetString(req.Isu, 10)
+					if !ok {
+						err = ErrMalformedRequest
+						break
+					}
+					room.do(func() {
+						err = addIsu(room, isu, req.Time)
+						if err == nil {
+							room.broadcastStatus()
+						}
+					})
+				case "buyItem":
+					room.do(func() {
+						err = buyItem(room, req.ItemID, req.CountBought, req.Time)
+						if err == nil {
+							room.broadcastStatus()
+						}
+					})
+				case "resync":
+					if !proto.delta {
+						err = ErrUnknownAction
+						break
+					}
+					err = room.resync(sub)
+				default:
+					err = ErrUnknownAction
 				}
+			}
+			if err != nil {
+				log.Println(roomName, req.Action, err)
+			}
+			if isProtocolError(err) {
+				protocolErrors++
+			}
+			res := newGameResponse(req.RequestID, err)
 
-				err = ws.WriteJSON(status)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+			// GameResponse を返却する前に 反映済みの GameStatus を返す
+			err = flush()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			select {
+			case <-sub.slow:
+				// GameStatus が抜けているので、GameResponse を返さずに再接続してもらう
+				closeSlow()
+				return
+			default:
 			}
 
-			err := ws.WriteJSON(GameResponse{
-				RequestID: req.RequestID,
-				IsSuccess: success,
-			})
+			out, err := proto.codec.marshal(res)
 			if err != nil {
 				log.Println(err)
 				return
 			}
-		case <-ticker.C:
-			status, err := getStatus(roomName)
+			err = write(out)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			err = ws.WriteJSON(status)
+			if protocolErrors >= config.WebSocket.MaxProtocolErrors {
+				log.Println(ws.RemoteAddr(), "too many protocol errors")
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many protocol errors"),
+					time.Now().Add(wsWriteWait))
+				return
+			}
+		case msg := <-sub.ch:
+			err := writePrepared(msg)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case <-pingTicker.C:
+			err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		case <-sub.moved:
+			err := flush()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			closeMoved()
+			return
+		case <-sub.slow:
+			err := flush()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			closeSlow()
+			return
+		case <-shutdown:
+			// 処理中のアクションは終わっているので、反映済みの GameStatus を送ってから閉じる
+			err := flush()
 			if err != nil {
 				log.Println(err)
 				return
 			}
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, closeReasonRestart),
+				time.Now().Add(wsWriteWait))
+			return
 		case <-ctx.Done():
 			return
 		}
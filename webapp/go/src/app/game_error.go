@@ -0,0 +1,36 @@
+package main
+
+// GameError は addIsu, buyItem が失敗した理由。GameResponse の error_code, message になる
+type GameError struct {
+	Code    string
+	Message string
+}
+
+func (e *GameError) Error() string {
+	return e.Message
+}
+
+var (
+	ErrReqTimeIsPast    = &GameError{Code: "req_time_is_past", Message: "reqTime is past"}
+	ErrRoomTimeIsFuture = &GameError{Code: "room_time_is_future", Message: "room time is future"}
+	ErrAlreadyBought    = &GameError{Code: "already_bought", Message: "item is already bought"}
+	ErrNotEnough        = &GameError{Code: "not_enough", Message: "not enough isu"}
+	ErrUnknownItem      = &GameError{Code: "unknown_item", Message: "unknown item"}
+	ErrMalformedRequest = &GameError{Code: "malformed_request", Message: "malformed request"}
+	ErrUnknownAction    = &GameError{Code: "unknown_action", Message: "unknown action"}
+	ErrRoomMoved        = &GameError{Code: "room_moved", Message: "room is moving to another host"}
+	ErrInternal         = &GameError{Code: "internal_error", Message: "internal error"}
+)
+
+// toGameError は err を GameError に変換する。GameError でないものは ErrInternal になる
+func toGameError(err error) *GameError {
+	if gerr, ok := err.(*GameError); ok {
+		return gerr
+	}
+	return ErrInternal
+}
+
+// isProtocolError は err がクライアントの送ったメッセージ自体の誤りかどうかを返す
+func isProtocolError(err error) bool {
+	return err == ErrMalformedRequest || err == ErrUnknownAction
+}
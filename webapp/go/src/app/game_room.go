@@ -0,0 +1,314 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	gameRoomsMu sync.Mutex
+	gameRooms   map[string]*gameRoom
+)
+
+// gameRoom は部屋ごとの goroutine。部屋の状態はこの goroutine だけが触る
+type gameRoom struct {
+	name string
+	refs int // gameRoomsMu で保護する
+
+	cmdCh chan func()
+	quit  chan struct{}
+
+	state       *roomState
+	subscribers map[*roomSubscriber]struct{}
+
+	// delta プロトコル用に最後に配信した GameStatus とその連番
+	lastStatus *GameStatus
+	seq        int64
+
+	roomTime       int64
+	roomTimeLoaded bool
+	lastTime       int64 // 最後に GameStatus かアクションで使った時刻。gameStore には書き込まない
+
+	// 別のホストに移した (移している) 部屋。アクションと新しい接続を受け付けない
+	frozen bool
+}
+
+// roomSubscriber は部屋の GameStatus を受け取る接続
+type roomSubscriber struct {
+	ch    chan *websocket.PreparedMessage
+	proto wsProtocol
+	moved chan struct{} // 部屋が別のホストに移ったら close される
+	slow  chan struct{} // 受け取りが詰まって配信をやめたら close される
+}
+
+// push は sub に msg を送る。受け取りが詰まっている接続は GameStatus が抜けてしまうので配信をやめ、
+// 再接続して StatusSnapshot から受け取り直してもらう。部屋の goroutine から呼ぶこと
+func (r *gameRoom) push(sub *roomSubscriber, msg *websocket.PreparedMessage) {
+	select {
+	case sub.ch <- msg:
+	default:
+		log.Println("subscriber is busy, close it")
+		close(sub.slow)
+		delete(r.subscribers, sub)
+	}
+}
+
+func initGameRooms() {
+	gameRooms = map[string]*gameRoom{}
+}
+
+// joinGameRoom は部屋を取得する。部屋の goroutine がなければ起動する。
+// 使い終わったら leave を呼ぶこと
+func joinGameRoom(roomName string) *gameRoom {
+	gameRoomsMu.Lock()
+	defer gameRoomsMu.Unlock()
+
+	r, ok := gameRooms[roomName]
+	if !ok {
+		r = &gameRoom{
+			name:        roomName,
+			cmdCh:       make(chan func()),
+			quit:        make(chan struct{}),
+			subscribers: map[*roomSubscriber]struct{}{},
+		}
+		gameRooms[roomName] = r
+		go r.run()
+	}
+	r.refs++
+	return r
+}
+
+// leave は部屋から抜ける。誰もいなくなったら部屋の goroutine を止める
+func (r *gameRoom) leave() {
+	gameRoomsMu.Lock()
+	defer gameRoomsMu.Unlock()
+
+	r.refs--
+	if r.refs == 0 {
+		delete(gameRooms, r.name)
+		close(r.quit)
+	}
+}
+
+func (r *gameRoom) run() {
+	ticker := time.NewTicker(time.Duration(config.Game.StatusIntervalMS) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case f := <-r.cmdCh:
+			f()
+		case <-ticker.C:
+			if len(r.subscribers) > 0 {
+				r.broadcastStatus()
+			}
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// do は f を部屋の goroutine で実行し、終わるまで待つ
+func (r *gameRoom) do(f func()) {
+	done := make(chan struct{})
+	r.cmdCh <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+// getState は部屋の状態を返す。初回と部屋のマスタが変わった後は gameStore から読み込む。
+// 部屋の goroutine から呼ぶこと
+func (r *gameRoom) getState(currentTime int64) (*roomState, error) {
+	if r.state != nil {
+		return r.state, nil
+	}
+	c, err := roomCatalog(r.name)
+	if err != nil {
+		return nil, err
+	}
+	s, err := loadRoomState(r.name, c.items, currentTime)
+	if err != nil {
+		return nil, err
+	}
+	r.state = s
+	return s, nil
+}
+
+// subscribe は部屋の GameStatus の配信を受け取るようにする。
+// 最初に現在の GameStatus (delta の場合は StatusSnapshot) が届く
+func (r *gameRoom) subscribe(proto wsProtocol) (*roomSubscriber, error) {
+	sub := &roomSubscriber{ch: make(chan *websocket.PreparedMessage, 16), proto: proto, moved: make(chan struct{}), slow: make(chan struct{})}
+	var err error
+	r.do(func() {
+		if r.frozen {
+			err = ErrRoomMoved
+			return
+		}
+		var msg *websocket.PreparedMessage
+		if proto.delta {
+			msg, err = r.encodeSnapshot(proto.codec)
+		} else {
+			msg, err = r.encodeStatus(proto.codec)
+		}
+		if err != nil {
+			return
+		}
+		r.subscribers[sub] = struct{}{}
+		r.push(sub, msg)
+	})
+	return sub, err
+}
+
+func (r *gameRoom) unsubscribe(sub *roomSubscriber) {
+	r.do(func() {
+		delete(r.subscribers, sub)
+	})
+}
+
+// resync は sub に StatusSnapshot を送り直す
+func (r *gameRoom) resync(sub *roomSubscriber) error {
+	var err error
+	r.do(func() {
+		if _, ok := r.subscribers[sub]; !ok {
+			// 配信をやめた接続は閉じられるので送らない
+			return
+		}
+		var msg *websocket.PreparedMessage
+		msg, err = r.encodeSnapshot(sub.proto.codec)
+		if err != nil {
+			return
+		}
+		r.push(sub, msg)
+	})
+	return err
+}
+
+// freeze は部屋のアクションを止める。部屋の goroutine から呼ぶこと
+func (r *gameRoom) freeze() {
+	r.frozen = true
+}
+
+// moved は部屋を別のホストに移した後に呼ぶ。読み込んだ状態を捨て、全ての接続に再接続させる。
+// 部屋の goroutine から呼ぶこと
+func (r *gameRoom) moved() {
+	r.state = nil
+	r.roomTimeLoaded = false
+	r.lastTime = 0
+	r.lastStatus = nil
+	for sub := range r.subscribers {
+		close(sub.moved)
+		delete(r.subscribers, sub)
+	}
+}
+
+// reset は gameStore の部屋のデータが置き換えられた後に呼ぶ。読み込んだ状態を捨て、アクションを受け付ける。
+// 部屋の goroutine から呼ぶこと
+func (r *gameRoom) reset() {
+	r.state = nil
+	r.roomTimeLoaded = false
+	r.lastTime = 0
+	r.lastStatus = nil
+	r.frozen = false
+}
+
+// resetGameRooms は gameStore を消した後に呼ぶ。全ての部屋の goroutine の状態を捨て、接続に再接続させる。
+// 状態を捨てた部屋の数を返す
+func resetGameRooms() int {
+	gameRoomsMu.Lock()
+	rooms := make([]*gameRoom, 0, len(gameRooms))
+	for _, r := range gameRooms {
+		r.refs++
+		rooms = append(rooms, r)
+	}
+	gameRoomsMu.Unlock()
+
+	for _, r := range rooms {
+		r.do(func() {
+			r.moved()
+			r.reset()
+		})
+		r.leave()
+	}
+	return len(rooms)
+}
+
+// broadcastStatus は GameStatus を一度だけ計算し、全ての接続に送る。
+// 全てのメッセージを作れたときだけ lastStatus と seq を進めるので、失敗しても次の delta は
+// 接続が最後に受け取った GameStatus との差分になる。部屋の goroutine から呼ぶこと
+func (r *gameRoom) broadcastStatus() {
+	status, err := getStatus(r)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	seq := r.seq + 1
+
+	// 同じプロトコルの接続には同じメッセージを送る。
+	// PreparedMessage にしておくと圧縮する接続でも圧縮は1度で済む
+	var delta interface{}
+	msgs := map[wsProtocol]*websocket.PreparedMessage{}
+	for sub := range r.subscribers {
+		if _, ok := msgs[sub.proto]; ok {
+			continue
+		}
+		var v interface{} = status
+		if sub.proto.delta {
+			if delta == nil {
+				if r.lastStatus == nil {
+					delta = newStatusSnapshot(seq, status)
+				} else {
+					delta = diffGameStatus(seq, r.lastStatus, status)
+				}
+			}
+			v = delta
+		}
+		msg, err := prepareMessage(sub.proto.codec, v)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		msgs[sub.proto] = msg
+	}
+
+	r.lastStatus = status
+	r.seq = seq
+	for sub := range r.subscribers {
+		r.push(sub, msgs[sub.proto])
+	}
+}
+
+func (r *gameRoom) encodeStatus(codec wsCodec) (*websocket.PreparedMessage, error) {
+	status, err := getStatus(r)
+	if err != nil {
+		return nil, err
+	}
+	return prepareMessage(codec, status)
+}
+
+// encodeSnapshot は最後に配信した GameStatus を StatusSnapshot にする。
+// 以降の StatusDelta はこれとの差分になる
+func (r *gameRoom) encodeSnapshot(codec wsCodec) (*websocket.PreparedMessage, error) {
+	if r.lastStatus == nil {
+		status, err := getStatus(r)
+		if err != nil {
+			return nil, err
+		}
+		r.lastStatus = status
+		r.seq++
+	}
+	return prepareMessage(codec, newStatusSnapshot(r.seq, r.lastStatus))
+}
+
+// prepareMessage は v を codec のメッセージにする
+func prepareMessage(codec wsCodec, v interface{}) (*websocket.PreparedMessage, error) {
+	b, err := codec.marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return websocket.NewPreparedMessage(codec.messageType(), b)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+)
+
+// gameSchemaVersion は gameStore に保存するデータのレイアウトのバージョン。レイアウトを変えたら上げること
+//
+//	1: 最初のレイアウト
+//	2: Redis の Buying を ro から buyings:<room>, buying_count:<room> に移した
+//	3: Redis の Adding を ro から addings:<room> に移した
+const gameSchemaVersion = 3
+
+var (
+	gameStore GameStore
+
+	// ErrOrdinalTaken はアイテムのその回数目の購入が既に行われていることを表す
+	ErrOrdinalTaken = errors.New("ordinal is already bought")
+	// ErrCatalogNotFound はそのバージョンのマスタが保存されていないことを表す
+	ErrCatalogNotFound = errors.New("catalog is not found")
+)
+
+// GameStore は Adding, Buying, 部屋の時刻の保存先
+type GameStore interface {
+	// AddAdding は部屋の時刻 t に isu を加算する
+	AddAdding(roomName string, t int64, isu *big.Int) error
+	// ListAddings は部屋の時刻 until までの Adding を時刻順に返す
+	ListAddings(roomName string, until int64) ([]*Adding, error)
+	// CompactAddings は部屋の時刻 until までの Adding を、時刻 until に isu を加算する1つの Adding にまとめる
+	CompactAddings(roomName string, until int64, isu *big.Int) error
+
+	// CountBuyings は部屋でアイテムが購入された回数を返す
+	CountBuyings(roomName string, itemID int) (int, error)
+	// ListBuyings は部屋の Buying を時刻順に返す
+	ListBuyings(roomName string) ([]*Buying, error)
+	// AddBuying は b.Ordinal が部屋でのアイテムの購入回数 + 1 と等しい場合だけ b を保存する。
+	// そうでない場合は ErrOrdinalTaken を返す。確認と保存はアトミックに行う
+	AddBuying(b *Buying) error
+
+	// GetRoomTime は部屋の時刻を返す。まだ無い場合は 0 を返す
+	GetRoomTime(roomName string) (int64, error)
+	// SetRoomTime は部屋の時刻を t に進める。保存済みの時刻より前には戻さない
+	SetRoomTime(roomName string, t int64) error
+
+	// ReplaceRoom は部屋の Adding, Buying を addings, buyings で置き換え、部屋の時刻を t まで進める。
+	// 部屋を別のホストに移すときに移動先で使う
+	ReplaceRoom(roomName string, addings []*Adding, buyings []*Buying, t int64) error
+
+	// SaveCatalog はバージョン version のマスタを保存する。同じバージョンは同じ内容なので上書きしてよい
+	SaveCatalog(version string, items []*mItem) error
+	// LoadCatalog はバージョン version のマスタを返す。無い場合は ErrCatalogNotFound を返す
+	LoadCatalog(version string) ([]*mItem, error)
+	// InitRoomCatalog は部屋のマスタのバージョンを返す。まだ無い場合は version を記録して返す
+	InitRoomCatalog(roomName, version string) (string, error)
+	// SetRoomCatalog は部屋のマスタのバージョンを version に書き換える
+	SetRoomCatalog(roomName, version string) error
+
+	// Shared は全てのホストが同じデータを読み書きするかを返す。
+	// 共有していない場合、部屋のデータは migrateRoom でしか別のホストに移せない
+	Shared() bool
+
+	// Reset はこのホストが保存した部屋のデータとバージョンを消す。マスタは消さない。
+	// Shared の場合は全てのホストの部屋のデータを消す
+	Reset() error
+	// ResetShared は全てのホストで共有している部屋の時刻とマスタのバージョンを消す。/initialize からだけ呼ぶ
+	ResetShared() error
+
+	// SchemaVersion は保存されているデータのバージョンを返す。まだ無い場合は 0 を返す
+	SchemaVersion() (int, error)
+	SetSchemaVersion(v int) error
+}
+
+// gameStoreMigrator は古いレイアウトのデータを今のレイアウトに移せる GameStore。
+// レイアウトの変わらない保存先は実装しなくてよい
+type gameStoreMigrator interface {
+	// MigrateSchema はバージョン from のデータを gameSchemaVersion のレイアウトに移す
+	MigrateSchema(from int) error
+}
+
+// initGameStore は config.Game.Store (redis, mysql, memory) で保存先を選ぶ
+func initGameStore() {
+	switch backend := config.Game.Store; backend {
+	case "redis":
+		gameStore = newRedisGameStore(redisPool, sharedRedisPool, config.Redis.URL == config.Redis.SharedURL)
+	case "mysql":
+		gameStore = newMySQLGameStore(db)
+	case "memory":
+		gameStore = newMemoryGameStore()
+	default:
+		panic(fmt.Sprintf("unknown ISU_GAME_STORE: %q", backend))
+	}
+	log.Printf("game store: %T", gameStore)
+}
+
+// prepareGameStore はデータのバージョンを確認する。reset の場合は先に全てのデータを消す。
+// 再起動してもデータは消さないので、レイアウトの違うデータを読まないようにここで止める
+func prepareGameStore(reset bool) {
+	if reset {
+		log.Println("resetting game store")
+		err := resetGameStore()
+		if err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	v, err := gameStore.SchemaVersion()
+	if err != nil {
+		panic(err)
+	}
+	switch v {
+	case gameSchemaVersion:
+	case 0, 1, 2:
+		// 0 は空か、バージョンを保存する前のデータ。どちらもレイアウトは 1 と同じ
+		from := v
+		if from == 0 {
+			from = 1
+		}
+		if m, ok := gameStore.(gameStoreMigrator); ok {
+			err := m.MigrateSchema(from)
+			if err != nil {
+				panic(err)
+			}
+		}
+		err := gameStore.SetSchemaVersion(gameSchemaVersion)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("game store has schema version %d, want %d. restart with -reset to discard the data", v, gameSchemaVersion))
+	}
+}
+
+// resetGameStore は全ての部屋のデータを消し、現在のバージョンを書き込む。
+// 同じ Redis を使っているとマスタも消えるので、今のマスタは保存し直す
+func resetGameStore() error {
+	err := gameStore.Reset()
+	if err != nil {
+		return err
+	}
+	if c := getCatalog(); c.version != "" {
+		err = gameStore.SaveCatalog(c.version, sortedItems(c.items))
+		if err != nil {
+			return err
+		}
+	}
+	return gameStore.SetSchemaVersion(gameSchemaVersion)
+}
+
+// RoomData は部屋を別のホストに移すときに送る部屋のデータ
+type RoomData struct {
+	RoomName       string    `json:"room_name"`
+	Time           int64     `json:"time"`
+	Addings        []*Adding `json:"addings"`
+	Buyings        []*Buying `json:"buyings"`
+	CatalogVersion string    `json:"catalog_version"`
+	CatalogItems   []*mItem  `json:"catalog_items"` // 移動先にマスタが無くても読み込めるように一緒に送る
+}
+
+// exportRoom は部屋のデータを読み出す
+func exportRoom(store GameStore, roomName string) (*RoomData, error) {
+	addings, err := listAllAddings(store, roomName)
+	if err != nil {
+		return nil, err
+	}
+	buyings, err := store.ListBuyings(roomName)
+	if err != nil {
+		return nil, err
+	}
+	t, err := store.GetRoomTime(roomName)
+	if err != nil {
+		return nil, err
+	}
+	version, err := store.InitRoomCatalog(roomName, getCatalog().version)
+	if err != nil {
+		return nil, err
+	}
+	items, err := store.LoadCatalog(version)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomData{
+		RoomName:       roomName,
+		Time:           t,
+		Addings:        addings,
+		Buyings:        buyings,
+		CatalogVersion: version,
+		CatalogItems:   items,
+	}, nil
+}
+
+// importRoom は exportRoom で読み出したデータで部屋を置き換える。一緒に送られたマスタに誤りがあれば置き換えない
+func importRoom(store GameStore, data *RoomData) error {
+	for _, a := range data.Addings {
+		a.RoomName = data.RoomName
+	}
+	for _, b := range data.Buyings {
+		b.RoomName = data.RoomName
+	}
+	if data.CatalogVersion != "" {
+		items, err := masterItemsByID(data.CatalogItems)
+		if err != nil {
+			return invalidCatalogError(err.Error())
+		}
+		err = validateCatalog(items, nil)
+		if err != nil {
+			return err
+		}
+		err = store.SaveCatalog(data.CatalogVersion, data.CatalogItems)
+		if err != nil {
+			return err
+		}
+		err = store.SetRoomCatalog(data.RoomName, data.CatalogVersion)
+		if err != nil {
+			return err
+		}
+	}
+	return store.ReplaceRoom(data.RoomName, data.Addings, data.Buyings, data.Time)
+}
+
+// listAllAddings は部屋の全ての Adding を時刻順に返す
+func listAllAddings(store GameStore, roomName string) ([]*Adding, error) {
+	return store.ListAddings(roomName, math.MaxInt64)
+}
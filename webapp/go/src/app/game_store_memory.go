@@ -0,0 +1,231 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"sync"
+)
+
+// memoryGameStore はプロセス内に保存する GameStore。テストや1台構成で使う
+type memoryGameStore struct {
+	mu        sync.Mutex
+	addings   map[string]map[int64]*big.Int // RoomName => Time => Isu
+	buyings   map[string][]*Buying          // RoomName => Buyings
+	roomTimes map[string]int64              // RoomName => Time
+	version   int
+
+	catalogs     map[string][]*mItem // Version => Items
+	roomCatalogs map[string]string   // RoomName => Version
+}
+
+func newMemoryGameStore() *memoryGameStore {
+	s := &memoryGameStore{catalogs: map[string][]*mItem{}}
+	s.Reset()
+	return s
+}
+
+func (s *memoryGameStore) AddAdding(roomName string, t int64, isu *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addings, ok := s.addings[roomName]
+	if !ok {
+		addings = map[int64]*big.Int{}
+		s.addings[roomName] = addings
+	}
+	if a, ok := addings[t]; ok {
+		a.Add(a, isu)
+	} else {
+		addings[t] = new(big.Int).Set(isu)
+	}
+	return nil
+}
+
+func (s *memoryGameStore) ListAddings(roomName string, until int64) ([]*Adding, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addings := []*Adding{}
+	for t, isu := range s.addings[roomName] {
+		if t <= until {
+			addings = append(addings, &Adding{RoomName: roomName, Time: t, Isu: isu.String()})
+		}
+	}
+	sort.Slice(addings, func(i, j int) bool { return addings[i].Time < addings[j].Time })
+	return addings, nil
+}
+
+func (s *memoryGameStore) CompactAddings(roomName string, until int64, isu *big.Int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addings, ok := s.addings[roomName]
+	if !ok {
+		addings = map[int64]*big.Int{}
+		s.addings[roomName] = addings
+	}
+	for t := range addings {
+		if t <= until {
+			delete(addings, t)
+		}
+	}
+	addings[until] = new(big.Int).Set(isu)
+	return nil
+}
+
+func (s *memoryGameStore) CountBuyings(roomName string, itemID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, b := range s.buyings[roomName] {
+		if b.ItemID == itemID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memoryGameStore) ListBuyings(roomName string) ([]*Buying, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buyings := make([]*Buying, len(s.buyings[roomName]))
+	copy(buyings, s.buyings[roomName])
+	return buyings, nil
+}
+
+func (s *memoryGameStore) AddBuying(b *Buying) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buyings := s.buyings[b.RoomName]
+	count := 0
+	for _, x := range buyings {
+		if x.ItemID == b.ItemID {
+			count++
+		}
+	}
+	if count+1 != b.Ordinal {
+		return ErrOrdinalTaken
+	}
+
+	i := sort.Search(len(buyings), func(i int) bool { return buyings[i].Time > b.Time })
+	buyings = append(buyings, nil)
+	copy(buyings[i+1:], buyings[i:])
+	buyings[i] = b
+	s.buyings[b.RoomName] = buyings
+	return nil
+}
+
+func (s *memoryGameStore) GetRoomTime(roomName string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.roomTimes[roomName], nil
+}
+
+func (s *memoryGameStore) SetRoomTime(roomName string, t int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.roomTimes[roomName] < t {
+		s.roomTimes[roomName] = t
+	}
+	return nil
+}
+
+func (s *memoryGameStore) ReplaceRoom(roomName string, addings []*Adding, buyings []*Buying, t int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := map[int64]*big.Int{}
+	for _, a := range addings {
+		m[a.Time] = str2big(a.Isu)
+	}
+	s.addings[roomName] = m
+
+	sorted := make([]*Buying, len(buyings))
+	copy(sorted, buyings)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
+	s.buyings[roomName] = sorted
+
+	if s.roomTimes[roomName] < t {
+		s.roomTimes[roomName] = t
+	}
+	return nil
+}
+
+func (s *memoryGameStore) SaveCatalog(version string, items []*mItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.catalogs[version] = copyMasterItems(items)
+	return nil
+}
+
+func (s *memoryGameStore) LoadCatalog(version string) ([]*mItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items, ok := s.catalogs[version]
+	if !ok {
+		return nil, ErrCatalogNotFound
+	}
+	return copyMasterItems(items), nil
+}
+
+func (s *memoryGameStore) InitRoomCatalog(roomName, version string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.roomCatalogs[roomName]; ok {
+		return v, nil
+	}
+	s.roomCatalogs[roomName] = version
+	return version, nil
+}
+
+func (s *memoryGameStore) SetRoomCatalog(roomName, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roomCatalogs[roomName] = version
+	return nil
+}
+
+func (s *memoryGameStore) Shared() bool {
+	return false
+}
+
+// ResetShared は何もしない。ホストの間で共有するデータは無い
+func (s *memoryGameStore) ResetShared() error {
+	return nil
+}
+
+func (s *memoryGameStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addings = map[string]map[int64]*big.Int{}
+	s.buyings = map[string][]*Buying{}
+	s.roomTimes = map[string]int64{}
+	s.roomCatalogs = map[string]string{}
+	s.version = 0
+	return nil
+}
+
+func (s *memoryGameStore) SchemaVersion() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.version, nil
+}
+
+func (s *memoryGameStore) SetSchemaVersion(v int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version = v
+	return nil
+}
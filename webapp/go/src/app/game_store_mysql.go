@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	mysqlErrDupEntry    = 1062 // ER_DUP_ENTRY
+	mysqlErrNoSuchTable = 1146 // ER_NO_SUCH_TABLE
+)
+
+// mysqlGameStore は db/isudb.sql の adding, buying, room_time, item_catalog, room_catalog, schema_version テーブルに保存する GameStore。
+// テーブルは作らないので、先に db/isudb.sql を流しておくこと
+type mysqlGameStore struct {
+	db *sqlx.DB
+}
+
+func newMySQLGameStore(db *sqlx.DB) *mysqlGameStore {
+	return &mysqlGameStore{db: db}
+}
+
+func (s *mysqlGameStore) AddAdding(roomName string, t int64, isu *big.Int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, '0') ON DUPLICATE KEY UPDATE isu=isu", roomName, t)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var isuStr string
+	err = tx.QueryRow("SELECT isu FROM adding WHERE room_name = ? AND time = ? FOR UPDATE", roomName, t).Scan(&isuStr)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	total := str2big(isuStr)
+	total.Add(total, isu)
+
+	_, err = tx.Exec("UPDATE adding SET isu = ? WHERE room_name = ? AND time = ?", total.String(), roomName, t)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlGameStore) ListAddings(roomName string, until int64) ([]*Adding, error) {
+	addings := []*Adding{}
+	err := s.db.Select(&addings, "SELECT room_name, time, isu FROM adding WHERE room_name = ? AND time <= ? ORDER BY time", roomName, until)
+	if err != nil {
+		return nil, err
+	}
+	return addings, nil
+}
+
+func (s *mysqlGameStore) CompactAddings(roomName string, until int64, isu *big.Int) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM adding WHERE room_name = ? AND time <= ?", roomName, until)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, ?)", roomName, until, isu.String())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlGameStore) CountBuyings(roomName string, itemID int) (int, error) {
+	var count int
+	err := s.db.Get(&count, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ?", roomName, itemID)
+	return count, err
+}
+
+func (s *mysqlGameStore) ListBuyings(roomName string) ([]*Buying, error) {
+	buyings := []*Buying{}
+	err := s.db.Select(&buyings, "SELECT room_name, item_id, ordinal, time FROM buying WHERE room_name = ? ORDER BY time", roomName)
+	if err != nil {
+		return nil, err
+	}
+	return buyings, nil
+}
+
+func (s *mysqlGameStore) AddBuying(b *Buying) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM buying WHERE room_name = ? AND item_id = ? FOR UPDATE", b.RoomName, b.ItemID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if count+1 != b.Ordinal {
+		tx.Rollback()
+		return ErrOrdinalTaken
+	}
+
+	_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", b.RoomName, b.ItemID, b.Ordinal, b.Time)
+	if err != nil {
+		tx.Rollback()
+		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == mysqlErrDupEntry {
+			return ErrOrdinalTaken
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlGameStore) GetRoomTime(roomName string) (int64, error) {
+	var t int64
+	err := s.db.Get(&t, "SELECT time FROM room_time WHERE room_name = ?", roomName)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return t, err
+}
+
+func (s *mysqlGameStore) SetRoomTime(roomName string, t int64) error {
+	_, err := s.db.Exec("INSERT INTO room_time(room_name, time) VALUES (?, ?) ON DUPLICATE KEY UPDATE time = GREATEST(time, VALUES(time))", roomName, t)
+	return err
+}
+
+func (s *mysqlGameStore) ReplaceRoom(roomName string, addings []*Adding, buyings []*Buying, t int64) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"adding", "buying"} {
+		_, err = tx.Exec("DELETE FROM "+table+" WHERE room_name = ?", roomName)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, a := range addings {
+		_, err = tx.Exec("INSERT INTO adding(room_name, time, isu) VALUES (?, ?, ?)", roomName, a.Time, a.Isu)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, b := range buyings {
+		_, err = tx.Exec("INSERT INTO buying(room_name, item_id, ordinal, time) VALUES(?, ?, ?, ?)", roomName, b.ItemID, b.Ordinal, b.Time)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO room_time(room_name, time) VALUES (?, ?) ON DUPLICATE KEY UPDATE time = GREATEST(time, VALUES(time))", roomName, t)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *mysqlGameStore) SaveCatalog(version string, items []*mItem) error {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT IGNORE INTO item_catalog(version, items) VALUES (?, ?)", version, b)
+	return err
+}
+
+func (s *mysqlGameStore) LoadCatalog(version string) ([]*mItem, error) {
+	var b []byte
+	err := s.db.Get(&b, "SELECT items FROM item_catalog WHERE version = ?", version)
+	if err == sql.ErrNoRows {
+		return nil, ErrCatalogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []*mItem
+	err = json.Unmarshal(b, &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (s *mysqlGameStore) InitRoomCatalog(roomName, version string) (string, error) {
+	_, err := s.db.Exec("INSERT IGNORE INTO room_catalog(room_name, version) VALUES (?, ?)", roomName, version)
+	if err != nil {
+		return "", err
+	}
+	var v string
+	err = s.db.Get(&v, "SELECT version FROM room_catalog WHERE room_name = ?", roomName)
+	return v, err
+}
+
+func (s *mysqlGameStore) SetRoomCatalog(roomName, version string) error {
+	_, err := s.db.Exec("INSERT INTO room_catalog(room_name, version) VALUES (?, ?) ON DUPLICATE KEY UPDATE version = VALUES(version)", roomName, version)
+	return err
+}
+
+// Shared は常に true。全てのホストが同じデータベースを使う
+func (s *mysqlGameStore) Shared() bool {
+	return true
+}
+
+// ResetShared は何もしない。Reset で全てのテーブルを消している
+func (s *mysqlGameStore) ResetShared() error {
+	return nil
+}
+
+func (s *mysqlGameStore) Reset() error {
+	for _, table := range []string{"adding", "buying", "room_time", "room_catalog", "schema_version"} {
+		_, err := s.db.Exec("TRUNCATE TABLE " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion は schema_version テーブルのバージョンを返す。
+// テーブルは db/isudb.sql で作る。テーブルが無い古いデータベースでは作るように促す
+func (s *mysqlGameStore) SchemaVersion() (int, error) {
+	var v int
+	err := s.db.Get(&v, "SELECT version FROM schema_version WHERE id = 1")
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == mysqlErrNoSuchTable {
+		return 0, fmt.Errorf("%v: create the tables in db/isudb.sql", err)
+	}
+	return v, err
+}
+
+func (s *mysqlGameStore) SetSchemaVersion(v int) error {
+	_, err := s.db.Exec("INSERT INTO schema_version(id, version) VALUES (1, ?) ON DUPLICATE KEY UPDATE version = VALUES(version)", v)
+	return err
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/izumin5210/ro"
+)
+
+// 保存済みの時刻より後の場合だけ部屋の時刻を更新する
+var setRoomTimeScript = redis.NewScript(1, `
+local t = redis.call("HGET", KEYS[1], ARGV[1])
+if not t or tonumber(t) < tonumber(ARGV[2]) then
+  redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+end
+return 0
+`)
+
+// アイテム ARGV[1] の購入回数が ARGV[2] - 1 の場合だけ、ARGV[2] 回目の Buying (時刻 ARGV[3]) を保存する。
+// KEYS[1] は buyings:<room>、KEYS[2] は buying_count:<room>、KEYS[3] は rooms、ARGV[4] は部屋名。保存した場合は 1 を返す
+var addBuyingScript = redis.NewScript(3, `
+local c = tonumber(redis.call("HGET", KEYS[2], ARGV[1]) or "0")
+if c + 1 ~= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call("HSET", KEYS[2], ARGV[1], ARGV[2])
+redis.call("HSET", KEYS[1], ARGV[1] .. ":" .. ARGV[2], ARGV[3])
+redis.call("SADD", KEYS[3], ARGV[4])
+return 1
+`)
+
+// redisGameStore は Redis に保存する GameStore。
+// Adding は addings:<room> (Time => Isu)、Buying は buyings:<room> (ItemID:Ordinal => Time) と
+// buying_count:<room> (ItemID => 購入回数) に pool に保存する。購入回数の確認と保存は pool の1つのスクリプトで行う。
+// pool にデータのある部屋は rooms に記録し、Reset ではその部屋だけを消す。
+// 部屋の時刻とマスタはホストをまたいで参照できるよう sharedPool に保存する
+type redisGameStore struct {
+	pool       *redis.Pool
+	sharedPool *redis.Pool
+	shared     bool // pool と sharedPool が同じ Redis
+
+	// 古いスキーマのバージョンで izumin5210/ro に保存した Adding, Buying を読むためだけに使う
+	addingStore ro.Store
+	buyingStore ro.Store
+}
+
+func newRedisGameStore(pool, sharedPool *redis.Pool, shared bool) *redisGameStore {
+	addingStore, err := ro.New(pool.Get, &Adding{}, ro.WithScorers(addingScorerFuncs))
+	if err != nil {
+		panic(err)
+	}
+	buyingStore, err := ro.New(pool.Get, &Buying{}, ro.WithScorers(buyingScorerFuncs))
+	if err != nil {
+		panic(err)
+	}
+	return &redisGameStore{
+		pool:        pool,
+		sharedPool:  sharedPool,
+		shared:      shared,
+		addingStore: addingStore,
+		buyingStore: buyingStore,
+	}
+}
+
+// redisMulti は MULTI/EXEC でまとめて実行するコマンド
+type redisMulti [][]interface{}
+
+func (m *redisMulti) add(cmd string, args ...interface{}) {
+	*m = append(*m, append([]interface{}{cmd}, args...))
+}
+
+// exec は conn でコマンドをまとめて実行する。送れなかったコマンドがあれば何も実行せず、
+// 実行したコマンドが失敗した場合はその誤りを返す
+func (m redisMulti) exec(conn redis.Conn) error {
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	for _, c := range m {
+		err = conn.Send(c[0].(string), c[1:]...)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	for i, r := range replies {
+		if err, ok := r.(redis.Error); ok {
+			return fmt.Errorf("%v: %v", m[i][0], err)
+		}
+	}
+	return nil
+}
+
+// addRoom は pool にデータのある部屋として記録する
+func (s *redisGameStore) addRoom(roomName string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SADD", "rooms", roomName)
+	return err
+}
+
+func addingsKey(roomName string) string {
+	return "addings:" + roomName
+}
+
+// AddAdding は同じ時刻の isu に足す。部屋の Adding を書き込むのは部屋の goroutine だけなので、読んでから書けばよい
+func (s *redisGameStore) AddAdding(roomName string, t int64, isu *big.Int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	total, err := redis.String(conn.Do("HGET", addingsKey(roomName), t))
+	if err == redis.ErrNil {
+		total, err = "0", nil
+	}
+	if err != nil {
+		return err
+	}
+	sum := str2big(total)
+	sum.Add(sum, isu)
+
+	var m redisMulti
+	m.add("SADD", "rooms", roomName)
+	m.add("HSET", addingsKey(roomName), t, sum.String())
+	return m.exec(conn)
+}
+
+// listAddings は部屋の全ての Adding を時刻順に返す
+func listAddings(conn redis.Conn, roomName string) ([]*Adding, error) {
+	m, err := redis.StringMap(conn.Do("HGETALL", addingsKey(roomName)))
+	if err != nil {
+		return nil, err
+	}
+	addings := make([]*Adding, 0, len(m))
+	for field, isu := range m {
+		t, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", addingsKey(roomName), field, err)
+		}
+		addings = append(addings, &Adding{RoomName: roomName, Time: t, Isu: isu})
+	}
+	sort.Slice(addings, func(i, j int) bool { return addings[i].Time < addings[j].Time })
+	return addings, nil
+}
+
+func (s *redisGameStore) ListAddings(roomName string, until int64) ([]*Adding, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	addings, err := listAddings(conn, roomName)
+	if err != nil {
+		return nil, err
+	}
+	n := sort.Search(len(addings), func(i int) bool { return addings[i].Time > until })
+	return addings[:n], nil
+}
+
+func (s *redisGameStore) CompactAddings(roomName string, until int64, isu *big.Int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	addings, err := listAddings(conn, roomName)
+	if err != nil {
+		return err
+	}
+	var m redisMulti
+	m.add("SADD", "rooms", roomName)
+	for _, a := range addings {
+		if a.Time <= until {
+			m.add("HDEL", addingsKey(roomName), a.Time)
+		}
+	}
+	m.add("HSET", addingsKey(roomName), until, isu.String())
+	return m.exec(conn)
+}
+
+func buyingsKey(roomName string) string {
+	return "buyings:" + roomName
+}
+
+func buyingCountKey(roomName string) string {
+	return "buying_count:" + roomName
+}
+
+func (s *redisGameStore) CountBuyings(roomName string, itemID int) (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	count, err := redis.Int(conn.Do("HGET", buyingCountKey(roomName), itemID))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *redisGameStore) ListBuyings(roomName string) ([]*Buying, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	m, err := redis.StringMap(conn.Do("HGETALL", buyingsKey(roomName)))
+	if err != nil {
+		return nil, err
+	}
+	buyings := make([]*Buying, 0, len(m))
+	for field, t := range m {
+		b := &Buying{RoomName: roomName}
+		_, err := fmt.Sscanf(field+":"+t, "%d:%d:%d", &b.ItemID, &b.Ordinal, &b.Time)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", buyingsKey(roomName), field, err)
+		}
+		buyings = append(buyings, b)
+	}
+	sort.Slice(buyings, func(i, j int) bool {
+		x, y := buyings[i], buyings[j]
+		if x.Time != y.Time {
+			return x.Time < y.Time
+		}
+		if x.ItemID != y.ItemID {
+			return x.ItemID < y.ItemID
+		}
+		return x.Ordinal < y.Ordinal
+	})
+	return buyings, nil
+}
+
+func (s *redisGameStore) AddBuying(b *Buying) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	ok, err := redis.Bool(addBuyingScript.Do(conn, buyingsKey(b.RoomName), buyingCountKey(b.RoomName), "rooms", b.ItemID, b.Ordinal, b.Time, b.RoomName))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrOrdinalTaken
+	}
+	return nil
+}
+
+// replaceAddings は部屋の Adding を addings で置き換えるコマンドを m に加える
+func replaceAddings(m *redisMulti, roomName string, addings []*Adding) {
+	m.add("SADD", "rooms", roomName)
+	m.add("DEL", addingsKey(roomName))
+	for _, a := range addings {
+		m.add("HSET", addingsKey(roomName), a.Time, a.Isu)
+	}
+}
+
+// replaceBuyings は部屋の Buying を buyings で置き換えるコマンドを m に加える
+func replaceBuyings(m *redisMulti, roomName string, buyings []*Buying) {
+	counts := map[int]int{}
+	m.add("SADD", "rooms", roomName)
+	m.add("DEL", buyingsKey(roomName), buyingCountKey(roomName))
+	for _, b := range buyings {
+		m.add("HSET", buyingsKey(roomName), fmt.Sprintf("%d:%d", b.ItemID, b.Ordinal), b.Time)
+		if counts[b.ItemID] < b.Ordinal {
+			counts[b.ItemID] = b.Ordinal
+		}
+	}
+	for itemID, count := range counts {
+		m.add("HSET", buyingCountKey(roomName), itemID, count)
+	}
+}
+
+func (s *redisGameStore) GetRoomTime(roomName string) (int64, error) {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	t, err := redis.Int64(conn.Do("HGET", "room_time", roomName))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return t, err
+}
+
+func (s *redisGameStore) SetRoomTime(roomName string, t int64) error {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	_, err := setRoomTimeScript.Do(conn, "room_time", roomName, t)
+	return err
+}
+
+// ReplaceRoom は pool の Adding, Buying を1つの MULTI/EXEC で置き換える。
+// 部屋の時刻は sharedPool にあるので、その後で進めるだけでよい
+func (s *redisGameStore) ReplaceRoom(roomName string, addings []*Adding, buyings []*Buying, t int64) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var m redisMulti
+	replaceAddings(&m, roomName, addings)
+	replaceBuyings(&m, roomName, buyings)
+	err := m.exec(conn)
+	if err != nil {
+		return err
+	}
+	return s.SetRoomTime(roomName, t)
+}
+
+// MigrateSchema は izumin5210/ro で pool に保存した古いバージョンのデータを今のレイアウトに移す。
+//
+//	1: Buying を buyings:<room>, buying_count:<room> に移し、sharedPool の buying_ordinal を消す
+//	2: Adding を addings:<room> に移す
+//
+// 部屋は sharedPool の room_time と pool の rooms から探し、pool にデータがあれば rooms に記録する
+func (s *redisGameStore) MigrateSchema(from int) error {
+	if from < 1 || from >= gameSchemaVersion {
+		return fmt.Errorf("cannot migrate game store from schema version %d", from)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	sharedConn := s.sharedPool.Get()
+	defer sharedConn.Close()
+
+	rooms, err := redis.Strings(sharedConn.Do("HKEYS", "room_time"))
+	if err != nil {
+		return err
+	}
+	localRooms, err := redis.Strings(conn.Do("SMEMBERS", "rooms"))
+	if err != nil {
+		return err
+	}
+	for _, roomName := range localRooms {
+		if !containsString(rooms, roomName) {
+			rooms = append(rooms, roomName)
+		}
+	}
+
+	migrated := 0
+	for _, roomName := range rooms {
+		addingQuery := s.addingStore.Query(fmt.Sprintf("%s:time", roomName))
+		addings := []*Adding{}
+		err = s.addingStore.Select(&addings, addingQuery)
+		if err != nil {
+			return err
+		}
+		buyingQuery := s.buyingStore.Query(fmt.Sprintf("%s:time", roomName))
+		buyings := []*Buying{}
+		if from <= 1 {
+			err = s.buyingStore.Select(&buyings, buyingQuery)
+			if err != nil {
+				return err
+			}
+		}
+		if len(addings) == 0 && len(buyings) == 0 {
+			continue
+		}
+
+		var m redisMulti
+		if len(addings) > 0 {
+			replaceAddings(&m, roomName, addings)
+		}
+		if len(buyings) > 0 {
+			replaceBuyings(&m, roomName, buyings)
+		}
+		err = m.exec(conn)
+		if err != nil {
+			return err
+		}
+		err = s.addingStore.RemoveBy(addingQuery)
+		if err != nil {
+			return err
+		}
+		if len(buyings) > 0 {
+			err = s.buyingStore.RemoveBy(buyingQuery)
+			if err != nil {
+				return err
+			}
+		}
+		migrated++
+	}
+	log.Printf("migrated game data of %d rooms from schema version %d", migrated, from)
+
+	if from <= 1 {
+		_, err = sharedConn.Do("DEL", "buying_ordinal")
+		return err
+	}
+	return nil
+}
+
+func (s *redisGameStore) SaveCatalog(version string, items []*mItem) error {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", "item_catalog", version, b)
+	return err
+}
+
+func (s *redisGameStore) LoadCatalog(version string) ([]*mItem, error) {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(conn.Do("HGET", "item_catalog", version))
+	if err == redis.ErrNil {
+		return nil, ErrCatalogNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []*mItem
+	err = json.Unmarshal(b, &items)
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (s *redisGameStore) InitRoomCatalog(roomName, version string) (string, error) {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSETNX", "room_catalog", roomName, version)
+	if err != nil {
+		return "", err
+	}
+	return redis.String(conn.Do("HGET", "room_catalog", roomName))
+}
+
+func (s *redisGameStore) SetRoomCatalog(roomName, version string) error {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", "room_catalog", roomName, version)
+	return err
+}
+
+func (s *redisGameStore) Shared() bool {
+	return s.shared
+}
+
+// Reset は rooms に記録した部屋の Adding, Buying と、sharedPool のその部屋の時刻とマスタのバージョンを消す。
+// pool と sharedPool が同じ Redis でも他のホストの部屋と部屋の割り当ては消さない
+func (s *redisGameStore) Reset() error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	rooms, err := redis.Strings(conn.Do("SMEMBERS", "rooms"))
+	if err != nil {
+		return err
+	}
+	var m redisMulti
+	for _, roomName := range rooms {
+		m.add("DEL", addingsKey(roomName), buyingsKey(roomName), buyingCountKey(roomName))
+	}
+	m.add("DEL", "rooms", "schema_version")
+	err = m.exec(conn)
+	if err != nil {
+		return err
+	}
+	if len(rooms) == 0 {
+		return nil
+	}
+
+	sharedConn := s.sharedPool.Get()
+	defer sharedConn.Close()
+
+	var shared redisMulti
+	shared.add("HDEL", redis.Args{}.Add("room_time").AddFlat(rooms)...)
+	shared.add("HDEL", redis.Args{}.Add("room_catalog").AddFlat(rooms)...)
+	return shared.exec(sharedConn)
+}
+
+func (s *redisGameStore) ResetShared() error {
+	conn := s.sharedPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", "room_time", "room_catalog")
+	return err
+}
+
+// SchemaVersion は pool の schema_version を返す。Reset で消える
+func (s *redisGameStore) SchemaVersion() (int, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	v, err := redis.Int(conn.Do("GET", "schema_version"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (s *redisGameStore) SetSchemaVersion(v int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", "schema_version", v)
+	return err
+}
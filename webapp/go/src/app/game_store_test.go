@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryGameStore(t *testing.T) {
+	assert := assert.New(t)
+	s := newMemoryGameStore()
+
+	assert.Nil(s.AddAdding("r", 200, big.NewInt(2)))
+	assert.Nil(s.AddAdding("r", 100, big.NewInt(1)))
+	assert.Nil(s.AddAdding("r", 200, big.NewInt(3)))
+	assert.Nil(s.AddAdding("other", 100, big.NewInt(7)))
+
+	addings, err := s.ListAddings("r", 150)
+	assert.Nil(err)
+	assert.Len(addings, 1)
+
+	addings, err = listAllAddings(s, "r")
+	assert.Nil(err)
+	assert.Len(addings, 2)
+	assert.Equal(int64(100), addings[0].Time)
+	assert.Equal("5", addings[1].Isu)
+
+	assert.Nil(s.CompactAddings("r", 150, big.NewInt(1)))
+	addings, err = listAllAddings(s, "r")
+	assert.Nil(err)
+	assert.Len(addings, 2)
+	assert.Equal(int64(150), addings[0].Time)
+
+	assert.Nil(s.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 1, Time: 300}))
+	assert.Nil(s.AddBuying(&Buying{RoomName: "r", ItemID: 2, Ordinal: 1, Time: 100}))
+	assert.Nil(s.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 2, Time: 400}))
+	assert.Equal(ErrOrdinalTaken, s.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 2, Time: 500}))
+	assert.Equal(ErrOrdinalTaken, s.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 4, Time: 500}))
+	count, err := s.CountBuyings("r", 1)
+	assert.Nil(err)
+	assert.Equal(2, count)
+	buyings, err := s.ListBuyings("r")
+	assert.Nil(err)
+	assert.Len(buyings, 3)
+	assert.Equal(2, buyings[0].ItemID)
+
+	assert.Nil(s.SaveCatalog("v1", []*mItem{{ItemID: 1}}))
+	_, err = s.LoadCatalog("v2")
+	assert.Equal(ErrCatalogNotFound, err)
+	version, err := s.InitRoomCatalog("r", "v1")
+	assert.Nil(err)
+	assert.Equal("v1", version)
+	version, _ = s.InitRoomCatalog("r", "v2")
+	assert.Equal("v1", version)
+	assert.Nil(s.SetRoomCatalog("r", "v2"))
+	version, _ = s.InitRoomCatalog("r", "v1")
+	assert.Equal("v2", version)
+
+	roomTime, err := s.GetRoomTime("r")
+	assert.Nil(err)
+	assert.Equal(int64(0), roomTime)
+	assert.Nil(s.SetRoomTime("r", 1234))
+	roomTime, err = s.GetRoomTime("r")
+	assert.Nil(err)
+	assert.Equal(int64(1234), roomTime)
+	assert.Nil(s.SetRoomTime("r", 1000))
+	roomTime, err = s.GetRoomTime("r")
+	assert.Nil(err)
+	assert.Equal(int64(1234), roomTime)
+
+	assert.Nil(s.Reset())
+	buyings, err = s.ListBuyings("r")
+	assert.Nil(err)
+	assert.Empty(buyings)
+	version, _ = s.InitRoomCatalog("r", "v1")
+	assert.Equal("v1", version)
+	items, err := s.LoadCatalog("v1")
+	assert.Nil(err)
+	assert.Len(items, 1)
+}
+
+func TestExportImportRoom(t *testing.T) {
+	assert := assert.New(t)
+	src := newMemoryGameStore()
+	dst := newMemoryGameStore()
+
+	assert.Nil(src.AddAdding("r", 100, big.NewInt(1)))
+	assert.Nil(src.AddAdding("r", 200, big.NewInt(2)))
+	assert.Nil(src.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 1, Time: 150}))
+	assert.Nil(src.SetRoomTime("r", 180))
+	assert.Nil(src.SaveCatalog("v1", []*mItem{{ItemID: 1, Power4: 1, Price4: 1}}))
+	assert.Nil(src.SetRoomCatalog("r", "v1"))
+
+	// 移動先に前の状態が残っていても置き換える
+	assert.Nil(dst.AddAdding("r", 50, big.NewInt(9)))
+	assert.Nil(dst.AddBuying(&Buying{RoomName: "r", ItemID: 2, Ordinal: 1, Time: 60}))
+
+	data, err := exportRoom(src, "r")
+	assert.Nil(err)
+	assert.Equal(int64(180), data.Time)
+	assert.Equal("v1", data.CatalogVersion)
+	assert.Nil(importRoom(dst, data))
+
+	got, err := exportRoom(dst, "r")
+	assert.Nil(err)
+	assert.Equal(data, got)
+	assert.Equal(ErrOrdinalTaken, dst.AddBuying(&Buying{RoomName: "r", ItemID: 1, Ordinal: 1, Time: 190}))
+}
+
+func TestPrepareGameStore(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore) { gameStore = s }(gameStore)
+	s := newMemoryGameStore()
+	gameStore = s
+
+	assert.Nil(s.AddAdding("r", 100, big.NewInt(1)))
+	prepareGameStore(false)
+	v, _ := s.SchemaVersion()
+	assert.Equal(gameSchemaVersion, v)
+
+	// 再起動してもデータは消えない
+	prepareGameStore(false)
+	addings, _ := listAllAddings(s, "r")
+	assert.Len(addings, 1)
+
+	assert.Nil(s.SetSchemaVersion(gameSchemaVersion + 1))
+	assert.Panics(func() { prepareGameStore(false) })
+
+	prepareGameStore(true)
+	v, _ = s.SchemaVersion()
+	assert.Equal(gameSchemaVersion, v)
+	addings, _ = listAllAddings(s, "r")
+	assert.Empty(addings)
+}
+
+// fakeRedisConn は送られたコマンドを記録し、EXEC で replies を返す redis.Conn
+type fakeRedisConn struct {
+	redis.Conn
+	sent    []string
+	sendErr map[string]error
+	replies []interface{}
+}
+
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	if err := c.sendErr[cmd]; err != nil {
+		return err
+	}
+	c.sent = append(c.sent, cmd)
+	return nil
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.sent = append(c.sent, cmd)
+	if cmd == "EXEC" {
+		return c.replies, nil
+	}
+	return "OK", nil
+}
+
+func TestRedisMultiExec(t *testing.T) {
+	assert := assert.New(t)
+
+	var m redisMulti
+	m.add("DEL", "addings:r")
+	m.add("HSET", "addings:r", 100, "1")
+
+	conn := &fakeRedisConn{replies: []interface{}{int64(1), int64(1)}}
+	assert.Nil(m.exec(conn))
+	assert.Equal([]string{"MULTI", "DEL", "HSET", "EXEC"}, conn.sent)
+
+	// 送れなかったら EXEC せずに捨てる
+	conn = &fakeRedisConn{sendErr: map[string]error{"HSET": errors.New("broken pipe")}}
+	assert.NotNil(m.exec(conn))
+	assert.Equal([]string{"MULTI", "DEL", "DISCARD"}, conn.sent)
+
+	// 実行したコマンドの失敗も返す
+	conn = &fakeRedisConn{replies: []interface{}{int64(1), redis.Error("OOM command not allowed")}}
+	assert.NotNil(m.exec(conn))
+}
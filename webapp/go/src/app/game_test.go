@@ -1,18 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"math/big"
 	"testing"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestStatusEmpty(t *testing.T) {
 	assert := assert.New(t)
 
-	mItems := map[int]mItem{}
-	addings := []Adding{}
-	buyings := []Buying{}
+	mItems := map[int]*mItem{}
+	addings := []*Adding{}
+	buyings := []*Buying{}
 
 	s, err := calcStatus(0, mItems, addings, buyings)
 
@@ -30,13 +33,13 @@ func TestStatusEmpty(t *testing.T) {
 func TestStatusAdd(t *testing.T) {
 	assert := assert.New(t)
 
-	mItems := map[int]mItem{}
-	addings := []Adding{
-		Adding{Time: 100, Isu: "1"},
-		Adding{Time: 200, Isu: "2"},
-		Adding{Time: 300, Isu: "1234567890123456789"},
+	mItems := map[int]*mItem{}
+	addings := []*Adding{
+		&Adding{Time: 100, Isu: "1"},
+		&Adding{Time: 200, Isu: "2"},
+		&Adding{Time: 300, Isu: "1234567890123456789"},
 	}
-	buyings := []Buying{}
+	buyings := []*Buying{}
 
 	s, err := calcStatus(0, mItems, addings, buyings)
 	assert.Nil(err)
@@ -77,13 +80,13 @@ func TestStatusBuySingle(t *testing.T) {
 		Power1: 0, Power2: 1, Power3: 0, Power4: 10,
 		Price1: 0, Price2: 1, Price3: 0, Price4: 10,
 	}
-	mItems := map[int]mItem{1: x}
+	mItems := map[int]*mItem{1: &x}
 	initialIsu := "10"
-	addings := []Adding{
-		Adding{Time: 0, Isu: initialIsu},
+	addings := []*Adding{
+		&Adding{Time: 0, Isu: initialIsu},
 	}
-	buyings := []Buying{
-		Buying{ItemID: 1, Ordinal: 1, Time: 100},
+	buyings := []*Buying{
+		&Buying{ItemID: 1, Ordinal: 1, Time: 100},
 	}
 	s, err := calcStatus(0, mItems, addings, buyings)
 	assert.Nil(err)
@@ -108,9 +111,9 @@ func TestOnSale(t *testing.T) {
 		Power1: 0, Power2: 1, Power3: 0, Power4: 1, // power: (0x+1)*1^(0x+1)
 		Price1: 0, Price2: 1, Price3: 0, Price4: 1, // price: (0x+1)*1^(0x+1)
 	}
-	mItems := map[int]mItem{1: x}
-	addings := []Adding{Adding{Time: 0, Isu: "1"}}
-	buyings := []Buying{Buying{ItemID: 1, Ordinal: 1, Time: 0}}
+	mItems := map[int]*mItem{1: &x}
+	addings := []*Adding{&Adding{Time: 0, Isu: "1"}}
+	buyings := []*Buying{&Buying{ItemID: 1, Ordinal: 1, Time: 0}}
 
 	s, err := calcStatus(1, mItems, addings, buyings)
 	assert.Nil(err)
@@ -141,16 +144,16 @@ func TestStatusBuy(t *testing.T) {
 		Power1: 1, Power2: 1, Power3: 7, Power4: 6,
 		Price1: 1, Price2: 1, Price3: 3, Price4: 2,
 	}
-	mItems := map[int]mItem{1: x, 2: y}
+	mItems := map[int]*mItem{1: &x, 2: &y}
 	initialIsu := "10000000"
-	addings := []Adding{
-		Adding{Time: 0, Isu: initialIsu},
+	addings := []*Adding{
+		&Adding{Time: 0, Isu: initialIsu},
 	}
-	buyings := []Buying{
-		Buying{ItemID: 1, Ordinal: 1, Time: 100},
-		Buying{ItemID: 1, Ordinal: 2, Time: 200},
-		Buying{ItemID: 2, Ordinal: 1, Time: 300},
-		Buying{ItemID: 2, Ordinal: 2, Time: 2001},
+	buyings := []*Buying{
+		&Buying{ItemID: 1, Ordinal: 1, Time: 100},
+		&Buying{ItemID: 1, Ordinal: 2, Time: 200},
+		&Buying{ItemID: 2, Ordinal: 1, Time: 300},
+		&Buying{ItemID: 2, Ordinal: 2, Time: 2001},
 	}
 
 	s, err := calcStatus(0, mItems, addings, buyings)
@@ -197,6 +200,75 @@ func TestStatusBuy(t *testing.T) {
 	assert.Contains(s.OnSale, OnSale{ItemID: 2, Time: 0})
 }
 
+// 少しずつ時刻を進めても一括で計算した場合と同じ状態になる
+func TestRoomStateAdvance(t *testing.T) {
+	assert := assert.New(t)
+
+	x := mItem{
+		ItemID: 1,
+		Power1: 1, Power2: 1, Power3: 3, Power4: 2,
+		Price1: 1, Price2: 1, Price3: 7, Price4: 6,
+	}
+	mItems := map[int]*mItem{1: &x}
+	addings := []*Adding{
+		&Adding{Time: 0, Isu: "10000"},
+		&Adding{Time: 150, Isu: "30"},
+		&Adding{Time: 1200, Isu: "5"},
+	}
+	buyings := []*Buying{
+		&Buying{ItemID: 1, Ordinal: 1, Time: 100},
+		&Buying{ItemID: 1, Ordinal: 2, Time: 700},
+	}
+
+	state := newRoomState("", mItems, 0)
+	for _, a := range addings {
+		state.addAdding(a.Time, str2big(a.Isu))
+	}
+	for _, b := range buyings {
+		state.addBuying(b)
+	}
+	assert.Equal(0, state.milliIsuAt(1300).Cmp(calcMilliIsu(1300, mItems, addings, buyings)))
+
+	for _, now := range []int64{50, 100, 150, 699, 1300} {
+		state.advance(now)
+		expected := calcMilliIsu(now, mItems, addings, buyings)
+		assert.Equal(0, state.milliIsu.Cmp(expected), "time %d", now)
+	}
+	assert.Equal(2, state.itemBuilt[1])
+	assert.Empty(state.addingAt)
+	assert.Empty(state.buyings)
+}
+
+func calcMilliIsu(now int64, mItems map[int]*mItem, addings []*Adding, buyings []*Buying) *big.Int {
+	s := newRoomState("", mItems, now)
+	for _, a := range addings {
+		s.addAdding(a.Time, str2big(a.Isu))
+	}
+	for _, b := range buyings {
+		s.addBuying(b)
+	}
+	return s.milliIsu
+}
+
+func TestReachTime(t *testing.T) {
+	assert := assert.New(t)
+
+	// 10 + 3t >= 20 となるのは t = 4
+	at, ok := reachTime(big.NewInt(10), big.NewInt(3), big.NewInt(20), 0, 1000)
+	assert.True(ok)
+	assert.Equal(int64(4), at)
+
+	_, ok = reachTime(big.NewInt(10), big.NewInt(3), big.NewInt(20), 0, 3)
+	assert.False(ok)
+
+	at, ok = reachTime(big.NewInt(20), big.NewInt(0), big.NewInt(20), 5, 10)
+	assert.True(ok)
+	assert.Equal(int64(6), at)
+
+	_, ok = reachTime(big.NewInt(10), big.NewInt(0), big.NewInt(20), 0, 1000)
+	assert.False(ok)
+}
+
 func TestMItem(t *testing.T) {
 	assert := assert.New(t)
 
@@ -222,3 +294,181 @@ func TestConv(t *testing.T) {
 	assert.Equal(Exponential{1234, 0}, big2exp(str2big("1234")))
 	assert.Equal(Exponential{111111111111110, 5}, big2exp(str2big("11111111111111000000")))
 }
+
+func TestGameResponse(t *testing.T) {
+	assert := assert.New(t)
+
+	// 成功した場合は今までと同じ JSON になる
+	b, err := json.Marshal(newGameResponse(1, nil))
+	assert.Nil(err)
+	assert.Equal(`{"request_id":1,"is_success":true}`, string(b))
+
+	b, err = json.Marshal(newGameResponse(2, ErrNotEnough))
+	assert.Nil(err)
+	assert.Equal(`{"request_id":2,"is_success":false,"error_code":"not_enough","message":"not enough isu"}`, string(b))
+
+	res := newGameResponse(3, errors.New("connection refused"))
+	assert.False(res.IsSuccess)
+	assert.Equal(ErrInternal.Code, res.ErrorCode)
+}
+
+func TestParseGameMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := parseGameMessage(jsonCodec{}, []byte(`{"request_id":1,"action":"addIsu","time":100,"isu":"10"}`))
+	assert.Nil(msg.err)
+	assert.Equal(GameRequest{RequestID: 1, Action: "addIsu", Time: 100, Isu: "10"}, msg.req)
+
+	// request_id が読めれば返す
+	msg = parseGameMessage(jsonCodec{}, []byte(`{"request_id":2,"action":"buyItem","item_id":"x"}`))
+	assert.Equal(ErrMalformedRequest, msg.err)
+	assert.Equal(2, msg.req.RequestID)
+
+	msg = parseGameMessage(jsonCodec{}, []byte(`{"request_id":3,`))
+	assert.Equal(ErrMalformedRequest, msg.err)
+	assert.Equal(0, msg.req.RequestID)
+}
+
+func TestDiffGameStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	prev := &GameStatus{
+		Time:   100,
+		Adding: []*Adding{&Adding{Time: 300, Isu: "1"}},
+		Schedule: []Schedule{
+			Schedule{Time: 100, MilliIsu: Exponential{10, 0}},
+			Schedule{Time: 300, MilliIsu: Exponential{1010, 0}},
+		},
+		Items: []Item{
+			Item{ItemID: 1, CountBought: 1},
+			Item{ItemID: 2, CountBought: 0},
+		},
+	}
+	cur := &GameStatus{
+		Time: 200,
+		Adding: []*Adding{
+			&Adding{Time: 300, Isu: "1"},
+			&Adding{Time: 400, Isu: "5"},
+		},
+		Schedule: []Schedule{
+			Schedule{Time: 200, MilliIsu: Exponential{10, 0}},
+			Schedule{Time: 300, MilliIsu: Exponential{1010, 0}},
+			Schedule{Time: 400, MilliIsu: Exponential{6010, 0}},
+		},
+		Items: []Item{
+			Item{ItemID: 2, CountBought: 1},
+			Item{ItemID: 1, CountBought: 1},
+		},
+		OnSale: []OnSale{OnSale{ItemID: 1, Time: 0}},
+	}
+
+	d := diffGameStatus(7, prev, cur)
+	assert.Equal(statusTypeDelta, d.Type)
+	assert.Equal(int64(7), d.Seq)
+	assert.Equal(int64(200), d.Time)
+	assert.Equal([]*Adding{&Adding{Time: 400, Isu: "5"}}, d.Adding)
+	assert.Len(d.Schedule, 2)
+	assert.Equal(int64(200), d.Schedule[0].Time)
+	assert.Equal(int64(400), d.Schedule[1].Time)
+	assert.Equal([]Item{Item{ItemID: 2, CountBought: 1}}, d.Items)
+	assert.Equal(cur.OnSale, d.OnSale)
+}
+
+func TestPushClosesSlowSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &gameRoom{subscribers: map[*roomSubscriber]struct{}{}}
+	sub := &roomSubscriber{ch: make(chan *websocket.PreparedMessage, 1), moved: make(chan struct{}), slow: make(chan struct{})}
+	msg1, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte("1"))
+	assert.Nil(err)
+	msg2, err := websocket.NewPreparedMessage(websocket.TextMessage, []byte("2"))
+	assert.Nil(err)
+	r.subscribers[sub] = struct{}{}
+
+	r.push(sub, msg1)
+	assert.Len(r.subscribers, 1)
+
+	r.push(sub, msg2)
+	assert.Len(r.subscribers, 0)
+	select {
+	case <-sub.slow:
+	default:
+		t.Error("slow subscriber is not closed")
+	}
+	assert.True(msg1 == <-sub.ch)
+}
+
+func TestRoomTimeIsSavedOnlyForActions(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore) { gameStore = s }(gameStore)
+	gameStore = newMemoryGameStore()
+
+	room := &gameRoom{name: "r"}
+	_, err := currentRoomTime(room, 0)
+	assert.Nil(err)
+	saved, _ := gameStore.GetRoomTime("r")
+	assert.Equal(int64(0), saved)
+
+	now, err := updateRoomTime(room, 0)
+	assert.Nil(err)
+	saved, _ = gameStore.GetRoomTime("r")
+	assert.Equal(now, saved)
+}
+
+func TestRoomTimeDoesNotGoBackAfterStatus(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore, now func() int64) {
+		gameStore = s
+		nowMilli = now
+	}(gameStore, nowMilli)
+	gameStore = newMemoryGameStore()
+
+	room := &gameRoom{name: "r"}
+	nowMilli = func() int64 { return 1000 }
+	_, err := currentRoomTime(room, 0)
+	assert.Nil(err)
+
+	// GameStatus を配信した後に時計が戻ったら、保存していなくてもアクションを受け付けない
+	nowMilli = func() int64 { return 900 }
+	assert.Equal(ErrRoomTimeIsFuture, buyItem(room, 1, 0, 2000))
+	saved, _ := gameStore.GetRoomTime("r")
+	assert.Equal(int64(0), saved)
+}
+
+// brokenCodec は marshal に失敗する wsCodec
+type brokenCodec struct{ jsonCodec }
+
+func (brokenCodec) marshal(v interface{}) ([]byte, error) {
+	return nil, errors.New("broken codec")
+}
+
+func TestBroadcastStatusKeepsSeqOnEncodeError(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore, now func() int64) {
+		gameStore = s
+		nowMilli = now
+	}(gameStore, nowMilli)
+	gameStore = newMemoryGameStore()
+	nowMilli = func() int64 { return 1000 }
+
+	r := &gameRoom{name: "r", state: newRoomState("r", map[int]*mItem{}, 0), subscribers: map[*roomSubscriber]struct{}{}}
+	newSub := func(proto wsProtocol) *roomSubscriber {
+		sub := &roomSubscriber{ch: make(chan *websocket.PreparedMessage, 1), proto: proto, moved: make(chan struct{}), slow: make(chan struct{})}
+		r.subscribers[sub] = struct{}{}
+		return sub
+	}
+	ok := newSub(wsProtocol{delta: true, codec: jsonCodec{}})
+	broken := newSub(wsProtocol{delta: true, codec: brokenCodec{}})
+
+	// どれか1つでも作れなければ誰にも送らず、次も同じ連番の StatusSnapshot を送る
+	r.broadcastStatus()
+	assert.Nil(r.lastStatus)
+	assert.Equal(int64(0), r.seq)
+	assert.Len(ok.ch, 0)
+
+	delete(r.subscribers, broken)
+	r.broadcastStatus()
+	assert.NotNil(r.lastStatus)
+	assert.Equal(int64(1), r.seq)
+	assert.Len(ok.ch, 1)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// /initialize は全てのホストのデータを消す。
+// ISU_WEB_HOSTS の各ホストの POST /admin/reset でそのホストの gameStore と部屋の goroutine の状態を消し、
+// 受け取ったホストが共有している部屋の時刻とマスタのバージョン、部屋の割り当てと接続数を消す。
+// 共有しているデータを消すのは /initialize だけで、-reset や POST /admin/reset はそのホストの部屋だけを消す。
+// /initialize も ISU_ADMIN_TOKEN を要求する。ISU_OPEN_INITIALIZE を設定した場合だけ認証しないが、
+// 各ホストの /admin/reset を呼ぶので ISU_ADMIN_TOKEN は必要
+
+// hostResetReport は1台のホストで消したもの
+type hostResetReport struct {
+	Host    string   `json:"host"`
+	Cleared []string `json:"cleared"`
+	Rooms   int      `json:"rooms"` // 状態を捨てた部屋の goroutine の数
+	Error   string   `json:"error,omitempty"`
+}
+
+type initializeReport struct {
+	Shared []string           `json:"shared"` // 消した共有 Redis のキー
+	Hosts  []*hostResetReport `json:"hosts"`
+	Error  string             `json:"error,omitempty"`
+}
+
+// resetLocal は自分の gameStore と部屋の goroutine の状態を消す
+func resetLocal() *hostResetReport {
+	report := &hostResetReport{Host: selfHost, Cleared: []string{}}
+
+	err := resetGameStore()
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Cleared = append(report.Cleared, fmt.Sprintf("game_store(%T)", gameStore))
+
+	report.Rooms = resetGameRooms()
+	report.Cleared = append(report.Cleared, "game_rooms")
+	return report
+}
+
+// resetShared は gameStore の共有しているデータと、共有 Redis の部屋の割り当てと接続数を消し、ホストの接続数を 0 に戻す
+func resetShared() ([]string, error) {
+	err := gameStore.ResetShared()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := sharedRedisPool.Get()
+	defer conn.Close()
+
+	keys := []string{"host:room", "host:member_count"}
+	conn.Send("MULTI")
+	conn.Send("DEL", redis.Args{}.AddFlat(keys)...)
+	for _, h := range webHosts {
+		conn.Send("ZADD", "host:member_count", 0, h)
+	}
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{fmt.Sprintf("game_store(%T)", gameStore)}, keys...), nil
+}
+
+// resetPeer は他のホストの POST /admin/reset を呼ぶ
+func resetPeer(host string) *hostResetReport {
+	report := &hostResetReport{Host: host}
+
+	req, err := http.NewRequest("POST", "http://"+host+"/admin/reset", nil)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	setAdminToken(req)
+	res, err := peerClient.Do(req)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(report)
+	if err != nil {
+		report.Error = fmt.Sprintf("%s: %v", res.Status, err)
+	} else if res.StatusCode != http.StatusOK && report.Error == "" {
+		report.Error = res.Status
+	}
+	report.Host = host
+	return report
+}
+
+func getInitializeHandler(w http.ResponseWriter, r *http.Request) {
+	report := &initializeReport{Shared: []string{}}
+	failed := false
+
+	shared, err := resetShared()
+	if err != nil {
+		log.Println(err)
+		report.Error = err.Error()
+		failed = true
+	} else {
+		report.Shared = shared
+	}
+
+	report.Hosts = make([]*hostResetReport, len(webHosts))
+	var wg sync.WaitGroup
+	for i, h := range webHosts {
+		wg.Add(1)
+		go func(i int, h string) {
+			defer wg.Done()
+			if h == selfHost {
+				report.Hosts[i] = resetLocal()
+			} else {
+				report.Hosts[i] = resetPeer(h)
+			}
+		}(i, h)
+	}
+	wg.Wait()
+	if selfHost == "" {
+		// ISU_WEB_HOSTS に自分が見つからない場合も自分は消す
+		report.Hosts = append(report.Hosts, resetLocal())
+	}
+
+	for _, h := range report.Hosts {
+		if h.Error != "" {
+			log.Println("initialize", h.Host, h.Error)
+			failed = true
+		}
+	}
+	status := http.StatusOK
+	if failed {
+		status = http.StatusInternalServerError
+	}
+	writeAdminJSON(w, status, report)
+}
+
+// POST /admin/reset
+// /initialize から呼ばれ、このホストのデータを消す
+func postResetHandler(w http.ResponseWriter, r *http.Request) {
+	report := resetLocal()
+	status := http.StatusOK
+	if report.Error != "" {
+		log.Println(report.Error)
+		status = http.StatusInternalServerError
+	}
+	writeAdminJSON(w, status, report)
+}
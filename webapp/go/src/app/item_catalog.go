@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+)
+
+// マスタは起動時に読み込み、POST /admin/items/reload か SIGHUP で読み込み直す。
+// マスタのバージョンは内容のハッシュで、読み込んだマスタはバージョンごとに gameStore に保存する。
+// 部屋は最初に読み込んだときのマスタのバージョンを記録し、以後はそのマスタで価格と生産量を計算する。
+// 読み込み直したマスタを使うのは新しい部屋と、POST /admin/rooms/{room_name}/catalog で移した部屋だけ
+
+// catalogMaxCount は検証するアイテムの購入回数の上限
+const catalogMaxCount = 1000000
+
+// itemCatalog はあるバージョンのマスタ。作った後は変更しない
+type itemCatalog struct {
+	version string
+	items   map[int]*mItem
+}
+
+var (
+	catalog   atomic.Value // *itemCatalog 新しい部屋に使うマスタ
+	catalogMu sync.Mutex   // 読み込み直しを1つずつ行う
+
+	catalogsMu sync.Mutex
+	catalogs   = map[string]*itemCatalog{} // Version => 読み込んだマスタ
+)
+
+func getCatalog() *itemCatalog {
+	c, _ := catalog.Load().(*itemCatalog)
+	if c == nil {
+		return &itemCatalog{items: map[int]*mItem{}}
+	}
+	return c
+}
+
+// newItemCatalog は items の内容からバージョンを決める
+func newItemCatalog(items map[int]*mItem) *itemCatalog {
+	b, _ := json.Marshal(sortedItems(items))
+	sum := sha1.Sum(b)
+	return &itemCatalog{version: hex.EncodeToString(sum[:])[:12], items: items}
+}
+
+func sortedItems(items map[int]*mItem) []*mItem {
+	list := make([]*mItem, 0, len(items))
+	for _, m := range items {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+// copyMasterItems はマスタに書く値だけを写したアイテムを返す。式と計算済みの値は持たない
+func copyMasterItems(items []*mItem) []*mItem {
+	list := make([]*mItem, 0, len(items))
+	for _, m := range items {
+		list = append(list, &mItem{
+			ItemID:       m.ItemID,
+			Power1:       m.Power1,
+			Power2:       m.Power2,
+			Power3:       m.Power3,
+			Power4:       m.Power4,
+			Price1:       m.Price1,
+			Price2:       m.Price2,
+			Price3:       m.Price3,
+			Price4:       m.Price4,
+			PowerFormula: m.PowerFormula,
+			PriceFormula: m.PriceFormula,
+			Synergy:      m.Synergy,
+		})
+	}
+	return list
+}
+
+// findCatalog はバージョン version のマスタを返す。読み込んでいなければ gameStore から読み込む
+func findCatalog(version string) (*itemCatalog, error) {
+	catalogsMu.Lock()
+	c, ok := catalogs[version]
+	catalogsMu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	list, err := gameStore.LoadCatalog(version)
+	if err != nil {
+		return nil, err
+	}
+	// linkFormulas はアイテムを書き換えるので、gameStore が返したものとは別に作る
+	items, err := masterItemsByID(copyMasterItems(list))
+	if err != nil {
+		return nil, err
+	}
+	// 他のホストや移動元が保存したマスタも循環などが無いことを確かめる
+	err = validateCatalog(items, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = linkFormulas(items)
+	if err != nil {
+		return nil, err
+	}
+	c = &itemCatalog{version: version, items: items}
+	catalogsMu.Lock()
+	catalogs[version] = c
+	catalogsMu.Unlock()
+	return c, nil
+}
+
+// roomCatalog は部屋のマスタを返す。まだ記録されていない部屋は今のマスタを使う
+func roomCatalog(roomName string) (*itemCatalog, error) {
+	version, err := gameStore.InitRoomCatalog(roomName, getCatalog().version)
+	if err != nil {
+		return nil, err
+	}
+	return findCatalog(version)
+}
+
+// initMasterItems はマスタを読み込む。失敗した場合は起動しない
+func initMasterItems() {
+	c, err := reloadCatalog()
+	if err != nil {
+		log.Fatalf("failed to load master items: %v", err)
+	}
+	log.Printf("loaded %d master items (version %s)", len(c.items), c.version)
+}
+
+// reloadCatalog はマスタを読み込んで検証し、問題なければ gameStore に保存して新しい部屋に使う。
+// 失敗した場合は今のマスタを使い続ける
+func reloadCatalog() (*itemCatalog, error) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+
+	items, err := loadMasterItems()
+	if err != nil {
+		return nil, err
+	}
+	err = validateCatalog(items, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = linkFormulas(items)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newItemCatalog(items)
+	err = gameStore.SaveCatalog(c.version, sortedItems(items))
+	if err != nil {
+		return nil, err
+	}
+	catalogsMu.Lock()
+	catalogs[c.version] = c
+	catalogsMu.Unlock()
+	catalog.Store(c)
+	return c, nil
+}
+
+// changeRoomCatalog は部屋のマスタをバージョン version (空の場合は今のマスタ) に移す。
+// 購入済みのアイテムが無いマスタには移さない。
+// 部屋の状態を読み込み直すので、部屋を担当しているホストか、まだ誰も担当していない部屋で呼ぶこと
+func changeRoomCatalog(roomName, version string) (*itemCatalog, error) {
+	conn := sharedRedisPool.Get()
+	current, err := redis.String(conn.Do("HGET", "host:room", roomName))
+	conn.Close()
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	if current != "" && current != selfHost {
+		return nil, errNotRoomOwner
+	}
+
+	target := getCatalog()
+	if version != "" {
+		target, err = findCatalog(version)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	room := joinGameRoom(roomName)
+	defer room.leave()
+	room.do(func() {
+		var buyings []*Buying
+		buyings, err = gameStore.ListBuyings(roomName)
+		if err != nil {
+			return
+		}
+		bought := map[int]bool{}
+		for _, b := range buyings {
+			bought[b.ItemID] = true
+		}
+		err = validateCatalog(target.items, bought)
+		if err != nil {
+			return
+		}
+		err = gameStore.SetRoomCatalog(roomName, target.version)
+		if err != nil {
+			return
+		}
+		// 次のアクションか配信で新しいマスタで読み込み直す
+		room.state = nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("moved room %q to catalog %s", roomName, target.version)
+	return target, nil
+}
+
+// validateCatalog は全ての誤りをまとめて返す。式の誤りは formulaProblems、相乗効果の誤りは synergyProblems を参照。
+// bought のアイテムは消せない
+func validateCatalog(items map[int]*mItem, bought map[int]bool) error {
+	problems := []string{}
+	ids := make([]int, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		m := items[id]
+		problems = append(problems, formulaProblems(m, "power", m.PowerFormula, m.Power1, m.Power2, m.Power3, m.Power4, items)...)
+		problems = append(problems, formulaProblems(m, "price", m.PriceFormula, m.Price1, m.Price2, m.Price3, m.Price4, items)...)
+		problems = append(problems, synergyProblems(m, items)...)
+	}
+
+	removed := []int{}
+	for id := range bought {
+		if _, ok := items[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	sort.Ints(removed)
+	for _, id := range removed {
+		problems = append(problems, fmt.Sprintf("item %d: removed but already bought", id))
+	}
+
+	if len(problems) > 0 {
+		return invalidCatalogError(strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// invalidCatalogError は validateCatalog で見つかった誤り
+type invalidCatalogError string
+
+func (e invalidCatalogError) Error() string {
+	return "invalid master items:\n  " + string(e)
+}
+
+func isInvalidCatalog(err error) bool {
+	_, ok := err.(invalidCatalogError)
+	return ok
+}
+
+// watchCatalogReload は SIGHUP を受け取ったらマスタを読み込み直す
+func watchCatalogReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c, err := reloadCatalog()
+			if err != nil {
+				log.Println("failed to reload master items:", err)
+				continue
+			}
+			log.Printf("reloaded %d master items (version %s)", len(c.items), c.version)
+		}
+	}()
+}
+
+// POST /admin/items/reload
+func postReloadItemsHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := reloadCatalog()
+	if err != nil {
+		log.Println(err)
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct {
+		Version string `json:"version"`
+		Items   int    `json:"items"`
+	}{c.version, len(c.items)})
+}
+
+// POST /admin/rooms/{room_name}/catalog?version={version}
+// 部屋を指定したバージョンのマスタに移す。version が無い場合は今のマスタに移す
+func postRoomCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+
+	c, err := changeRoomCatalog(roomName, r.URL.Query().Get("version"))
+	switch {
+	case err == errNotRoomOwner:
+		writeAdminError(w, http.StatusConflict, err.Error())
+		return
+	case err == ErrCatalogNotFound:
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	case isInvalidCatalog(err):
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	case err != nil:
+		log.Println(err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct {
+		RoomName string `json:"room_name"`
+		Version  string `json:"version"`
+	}{roomName, c.version})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCatalog(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := &mItem{ItemID: 1, Power1: 0, Power2: 1, Power3: 0, Power4: 1, Price1: 0, Price2: 1, Price3: 1, Price4: 1}
+	assert.Nil(validateCatalog(map[int]*mItem{1: ok}, map[int]bool{1: true}))
+
+	err := validateCatalog(map[int]*mItem{
+		1: ok,
+		2: {ItemID: 2, Power4: 0, Price4: 1},
+		3: {ItemID: 3, Power3: math.MaxInt64 / 10, Power4: 1, Price4: 1},
+		4: {ItemID: 4, Power1: -1, Power4: 1, Price4: 1},
+	}, map[int]bool{1: true, 5: true})
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "item 2: power base 0 is not positive")
+		assert.Contains(err.Error(), "item 3: power overflows int64")
+		assert.Contains(err.Error(), "item 4: power coefficients must not be negative")
+		assert.Contains(err.Error(), "item 5: removed but already bought")
+	}
+}
+
+func TestReloadCatalog(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore, path string) {
+		gameStore = s
+		config.MasterItems = path
+	}(gameStore, config.MasterItems)
+
+	dir, err := ioutil.TempDir("", "catalog")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "items.csv")
+	config.MasterItems = path
+	gameStore = newMemoryGameStore()
+
+	assert.Nil(ioutil.WriteFile(path, []byte("item_id,power1,power2,power3,power4,price1,price2,price3,price4\n1,0,1,0,1,0,1,1,1\n2,0,1,0,1,0,1,1,1\n"), 0644))
+	c1, err := reloadCatalog()
+	assert.Nil(err)
+	assert.Len(c1.items, 2)
+	assert.True(getCatalog() == c1)
+
+	room := &gameRoom{name: "r"}
+	s1, err := room.getState(0)
+	assert.Nil(err)
+	s, _ := room.getState(0)
+	assert.True(s1 == s)
+
+	// 不正なマスタには差し替えない
+	assert.Nil(ioutil.WriteFile(path, []byte("item_id,power1,power2,power3,power4,price1,price2,price3,price4\n1,0,1,0,0,0,1,1,1\n"), 0644))
+	_, err = reloadCatalog()
+	assert.NotNil(err)
+	assert.True(getCatalog() == c1)
+
+	// 同じ内容なら同じバージョン
+	assert.Nil(ioutil.WriteFile(path, []byte("item_id,power1,power2,power3,power4,price1,price2,price3,price4\n2,0,1,0,1,0,1,1,1\n1,0,1,0,1,0,1,1,1\n"), 0644))
+	c, err := reloadCatalog()
+	assert.Nil(err)
+	assert.Equal(c1.version, c.version)
+
+	assert.Nil(ioutil.WriteFile(path, []byte("item_id,power1,power2,power3,power4,price1,price2,price3,price4\n1,0,2,0,1,0,1,1,1\n"), 0644))
+	c2, err := reloadCatalog()
+	assert.Nil(err)
+	assert.NotEqual(c1.version, c2.version)
+
+	// 既にある部屋は読み込み直しても最初のマスタのまま
+	room = &gameRoom{name: "r"}
+	s2, err := room.getState(0)
+	assert.Nil(err)
+	assert.Equal(int64(1), s2.mItems[1].Power2)
+	assert.Len(s2.mItems, 2)
+
+	// 新しい部屋は新しいマスタを使う
+	room = &gameRoom{name: "new"}
+	s3, err := room.getState(0)
+	assert.Nil(err)
+	assert.Equal(int64(2), s3.mItems[1].Power2)
+
+	// 他のホストやプロセスを再起動した後も gameStore から古いマスタを読める
+	catalogsMu.Lock()
+	delete(catalogs, c1.version)
+	catalogsMu.Unlock()
+	old, err := findCatalog(c1.version)
+	assert.Nil(err)
+	assert.Len(old.items, 2)
+	_, err = findCatalog("unknown")
+	assert.Equal(ErrCatalogNotFound, err)
+}
+
+func TestFindCatalogValidates(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore) { gameStore = s }(gameStore)
+	gameStore = newMemoryGameStore()
+
+	// 保存されたマスタに循環があっても読み込まない
+	assert.Nil(gameStore.SaveCatalog("cycle", []*mItem{
+		{ItemID: 1, PowerFormula: &FormulaSpec{Kind: formulaMultiplier, Item: 2, Factor: 2}, Price4: 1},
+		{ItemID: 2, PowerFormula: &FormulaSpec{Kind: formulaMultiplier, Item: 1, Factor: 2}, Price4: 1},
+	}))
+	_, err := findCatalog("cycle")
+	assert.True(isInvalidCatalog(err))
+
+	// gameStore のアイテムは書き換えない
+	assert.Nil(gameStore.SaveCatalog("ok", []*mItem{{ItemID: 1, Power4: 1, Price4: 1}}))
+	c, err := findCatalog("ok")
+	assert.Nil(err)
+	assert.NotNil(c.items[1].power)
+	list, err := gameStore.LoadCatalog("ok")
+	assert.Nil(err)
+	assert.Nil(list[0].power)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+)
+
+// itemTable は Formula の値と累積和を購入回数 x ごとに覚えておく表。
+// 足りない分は呼ばれたときに伸ばす。(cx+1)*d^(ax+b) の場合、d^(a(x+1)+b) は d^(ax+b) に d^a を掛けて求める。
+// 複数の goroutine から同時に読んでよい
+type itemTable struct {
+	mu     sync.RWMutex
+	values []*big.Int // values[x] = f(x)
+	sums   []*big.Int // sums[x] = values[1] + ... + values[x]
+	pow    *big.Int   // d^(ax+b) (x = len(values)-1)
+	step   *big.Int   // d^a
+}
+
+// get は x 回目の値と 1 回目から x 回目までの和を返す。x は 0 以上
+func (t *itemTable) get(f Formula, x int) (value, sum *big.Int) {
+	t.mu.RLock()
+	if x < len(t.values) {
+		value, sum = t.values[x], t.sums[x]
+		t.mu.RUnlock()
+		return value, sum
+	}
+	t.mu.RUnlock()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.values) <= x {
+		t.extend(f)
+	}
+	return t.values[x], t.sums[x]
+}
+
+// extend は表を1つ伸ばす
+func (t *itemTable) extend(f Formula) {
+	x := len(t.values)
+	var v *big.Int
+	if e, ok := f.(*expFormula); ok {
+		v = t.nextExp(e, int64(x))
+	} else {
+		v = f.At(x)
+	}
+
+	sum := new(big.Int)
+	if x > 0 {
+		sum.Add(t.sums[x-1], v)
+	}
+	t.values = append(t.values, v)
+	t.sums = append(t.sums, sum)
+}
+
+func (t *itemTable) nextExp(f *expFormula, x int64) *big.Int {
+	if x == 0 || f.a < 0 || f.b < 0 {
+		// 負の指数は big.Int.Exp と同じく 1 になるので、掛け算では伸ばさずにその都度求める
+		t.pow = new(big.Int).Exp(big.NewInt(f.d), big.NewInt(f.a*x+f.b), nil)
+	} else {
+		if t.step == nil {
+			t.step = new(big.Int).Exp(big.NewInt(f.d), big.NewInt(f.a), nil)
+		}
+		t.pow = new(big.Int).Mul(t.pow, t.step)
+	}
+	return new(big.Int).Mul(big.NewInt(f.c*x+1), t.pow)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemTable(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, f := range [][4]int64{{1, 2, 2, 3}, {5, 4, 3, 2}, {0, 0, 0, 7}, {-1, 3, 1, 2}, {2, -5, 0, 3}} {
+		a, b, c, d := f[0], f[1], f[2], f[3]
+		formula := &expFormula{a, b, c, d}
+		var table itemTable
+		sum := new(big.Int)
+		// 表を飛ばして伸ばしても、途中から読んでも同じ値になる
+		value, _ := table.get(formula, 5)
+		assert.Equal(0, value.Cmp(formula.At(5)), "%v", f)
+		for x := 0; x <= 20; x++ {
+			want := formula.At(x)
+			if x > 0 {
+				sum.Add(sum, want)
+			}
+			value, total := table.get(formula, x)
+			assert.Equal(0, value.Cmp(want), "%v x=%d", f, x)
+			assert.Equal(0, total.Cmp(sum), "%v x=%d", f, x)
+		}
+	}
+
+	// 同時に読んでも同じ値を返す
+	item := &mItem{ItemID: 1, Price1: 3, Price2: 1, Price3: 2, Price4: 10}
+	var wg sync.WaitGroup
+	got := make([]*big.Int, 8)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			got[i] = item.GetPrice(50 + i%3)
+		}(i)
+	}
+	wg.Wait()
+	for i, v := range got {
+		assert.True(v == item.GetPrice(50+i%3))
+	}
+	assert.Equal(0, item.TotalPrice(2).Cmp(new(big.Int).Add(item.GetPrice(1), item.GetPrice(2))))
+}
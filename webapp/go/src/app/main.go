@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -9,8 +11,8 @@ import (
 	_ "net/http/pprof"
 	"net/url"
 	"os"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -20,73 +22,63 @@ import (
 )
 
 var (
-	db              *sqlx.DB
-	webHosts        []string
-	muxByRoomNameMu sync.Mutex
-	muxByRoomName   map[string]*sync.Mutex
+	db       *sqlx.DB
+	webHosts []string
 )
 
 func initHosts() {
-	webHosts = strings.Split(os.Getenv("ISU_WEB_HOSTS"), ",")
+	webHosts = config.WebHosts
 	log.Println(webHosts)
 }
 
 func initDB() {
-	db_host := os.Getenv("ISU_DB_HOST")
-	if db_host == "" {
-		db_host = "127.0.0.1"
-	}
-	db_port := os.Getenv("ISU_DB_PORT")
-	if db_port == "" {
-		db_port = "3306"
-	}
-	db_user := os.Getenv("ISU_DB_USER")
-	if db_user == "" {
-		db_user = "root"
-	}
-	db_password := os.Getenv("ISU_DB_PASSWORD")
-	if db_password != "" {
-		db_password = ":" + db_password
+	password := config.DB.Password
+	if password != "" {
+		password = ":" + password
 	}
 
-	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isudb?parseTime=true&loc=Local&charset=utf8mb4",
-		db_user, db_password, db_host, db_port)
+	dsn := fmt.Sprintf("%s%s@tcp(%s:%d)/%s?parseTime=true&loc=Local&charset=utf8mb4",
+		config.DB.User, password, config.DB.Host, config.DB.Port, config.DB.Name)
+
+	addr := fmt.Sprintf("%s@tcp(%s:%d)/%s", config.DB.User, config.DB.Host, config.DB.Port, config.DB.Name)
+	log.Printf("Connecting to db: %s", addr)
+	var err error
+	db, err = sqlx.Open("mysql", dsn)
+	if err != nil {
+		log.Fatalf("invalid db config: %v", err)
+	}
 
-	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
+	// MySQL が起動するまで db.connect_timeout_sec の間だけ待つ
+	deadline := time.Now().Add(time.Duration(config.DB.ConnectTimeoutSec) * time.Second)
 	for {
-		err := db.Ping()
+		err = db.Ping()
 		if err == nil {
 			break
 		}
+		if time.Now().After(deadline) {
+			log.Fatalf("cannot connect to db %s within %ds: %v", addr, config.DB.ConnectTimeoutSec, err)
+		}
 		log.Println(err)
 		time.Sleep(time.Second * 3)
 	}
 
-	db.SetMaxOpenConns(20)
+	db.SetMaxOpenConns(config.DB.MaxOpenConns)
 	db.SetConnMaxLifetime(5 * time.Minute)
 	log.Printf("Succeeded to connect db.")
 }
 
-func getInitializeHandler(w http.ResponseWriter, r *http.Request) {
-	db.MustExec("TRUNCATE TABLE adding")
-	db.MustExec("TRUNCATE TABLE buying")
-	db.MustExec("TRUNCATE TABLE room_time")
-	w.WriteHeader(204)
-}
-
 func getRoomHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	roomName := vars["room_name"]
 	path := "/ws/" + url.PathEscape(roomName)
 
-	muxByRoomNameMu.Lock()
-	if _, ok := muxByRoomName[roomName]; !ok {
-		muxByRoomName[roomName] = new(sync.Mutex)
+	host, err := getHostFromRoomName(roomName)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
 	}
-	host := getHostFromRoomName(roomName)
-	muxByRoomNameMu.Unlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(struct {
@@ -102,43 +94,122 @@ func wsGameHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	roomName := vars["room_name"]
-	addMemberToRoom(roomName)
 
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		log.Println("Failed to upgrade", err)
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// HandshakeError の場合は wsUpgrader.Error がレスポンスを返している
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			log.Println("Failed to upgrade", err)
+		}
 		return
 	}
-	go serveGameConn(ws, roomName)
+	if err := ws.SetCompressionLevel(wsCompressionLevel); err != nil {
+		log.Println(err)
+	}
+	proto := wsProtocol{
+		delta: r.URL.Query().Get("protocol") == "delta",
+		codec: selectCodec(r, ws.Subprotocol()),
+	}
+	wsConns.serve(ws, roomName, proto)
 }
 
 func main() {
-	initDB()
+	configPath := flag.String("config", os.Getenv("ISU_CONFIG"), "config file (.toml or .yaml) ($ISU_CONFIG)")
+	printConfig := flag.Bool("print-config", false, "print the config and exit")
+	resetOnStart := flag.Bool("reset", false, "discard the game data of the rooms stored by this host on startup")
+	configFlags := registerConfigFlags(flag.CommandLine)
+	flag.Parse()
+
+	c, err := loadConfig(*configPath, os.LookupEnv, configFlags)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config = c
+	if *printConfig {
+		err := writeConfig(os.Stdout, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// 管理用エンドポイントと /initialize は ISU_ADMIN_TOKEN が無いと使えないので起動しない
+	if config.AdminToken == "" {
+		fmt.Fprintln(os.Stderr, "admin_token ($ISU_ADMIN_TOKEN) must be set")
+		os.Exit(2)
+	}
+
+	if config.usesDB() {
+		initDB()
+	}
 	initRedisPool()
 	initHosts()
+	initPlacement()
 	initRoom()
-	initRoomTime()
-	initMasterItems(db)
-	initAddingStore()
-	initBuyingStore()
-	muxByRoomName = map[string]*sync.Mutex{}
-
-	if debug {
+	initGameRooms()
+	initWsUpgrader()
+	initGameStore()
+	prepareGameStore(*resetOnStart)
+	initMasterItems()
+	watchCatalogReload()
+
+	if config.Debug {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
-		go func() {
-			log.Println(http.ListenAndServe(":6060", nil))
-		}()
+		if config.PprofListen != "" {
+			go func() {
+				log.Println(http.ListenAndServe(config.PprofListen, nil))
+			}()
+		}
 	} else {
 		log.SetOutput(ioutil.Discard)
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/initialize", getInitializeHandler)
+	// 認証情報を付けられないベンチマーカーのために、open_initialize の場合だけ認証しない
+	if config.OpenInitialize {
+		r.HandleFunc("/initialize", getInitializeHandler)
+	} else {
+		r.HandleFunc("/initialize", requireAdmin(getInitializeHandler))
+	}
+	r.HandleFunc("/admin/reset", requireAdmin(postResetHandler)).Methods("POST")
 	r.HandleFunc("/room/", getRoomHandler)
 	r.HandleFunc("/room/{room_name}", getRoomHandler)
+	r.HandleFunc("/admin/rooms/{room_name}/migrate", requireAdmin(postMigrateRoomHandler)).Methods("POST")
+	r.HandleFunc("/admin/rooms/{room_name}/data", requireAdmin(putRoomDataHandler)).Methods("PUT")
+	r.HandleFunc("/admin/rooms/{room_name}/catalog", requireAdmin(postRoomCatalogHandler)).Methods("POST")
+	r.HandleFunc("/admin/items/reload", requireAdmin(postReloadItemsHandler)).Methods("POST")
 	r.HandleFunc("/ws/", wsGameHandler)
 	r.HandleFunc("/ws/{room_name}", wsGameHandler)
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../public/")))
 
-	log.Fatal(http.ListenAndServe(":5000", handlers.LoggingHandler(os.Stderr, r)))
+	srv := &http.Server{Addr: config.Listen, Handler: handlers.LoggingHandler(os.Stderr, r)}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Println("received", <-sig)
+	shutdown(srv)
+}
+
+// shutdown は heartbeat を止めて新しいリクエストの受け付けを止め、全ての websocket 接続を閉じてから戻る。
+// 部屋の割り当ては残すので、再起動した後も同じ部屋を担当する。
+// 接続ごとに部屋の人数は戻される
+func shutdown(srv *http.Server) {
+	timeout := time.Duration(config.ShutdownTimeoutSec) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	leavePlacement()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Println(err)
+	}
+	wsConns.closeAll(timeout)
+	log.Println("shutdown completed")
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+)
+
+// 部屋を別のホストに移す。
+//   1. 移動元で部屋を止め (freeze)、gameStore から部屋のデータを読み出す
+//   2. 移動先の PUT /admin/rooms/{room_name}/data に送り、移動先の gameStore を置き換える
+//   3. host:room を移動先に書き換え、移動元の接続に再接続させる
+// 途中で失敗した場合は部屋を元に戻す
+
+var (
+	errNotRoomOwner = errors.New("room is not assigned to this host")
+
+	// 他のホストの管理用エンドポイントを呼ぶクライアント
+	peerClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// migrateRoom は自分が担当している部屋を to に移す
+func migrateRoom(roomName, to string) error {
+	conn := sharedRedisPool.Get()
+	defer conn.Close()
+
+	current, err := redis.String(conn.Do("HGET", "host:room", roomName))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+	if selfHost == "" || current != selfHost {
+		return errNotRoomOwner
+	}
+
+	live, err := liveHosts(conn)
+	if err != nil {
+		return err
+	}
+	if !containsString(live, to) || to == selfHost {
+		return fmt.Errorf("%q is not a live host", to)
+	}
+
+	room := joinGameRoom(roomName)
+	defer room.leave()
+
+	// 処理中のアクションが終わってから止めて読み出す
+	var data *RoomData
+	room.do(func() {
+		room.freeze()
+		data, err = exportRoom(gameStore, roomName)
+	})
+	if err == nil {
+		err = sendRoomData(to, data)
+	}
+	if err == nil {
+		var host string
+		host, err = redis.String(assignHostScript.Do(conn, "host:room", roomName, selfHost, to))
+		if err == nil && host != to {
+			err = fmt.Errorf("room %q was reassigned to %s", roomName, host)
+		}
+	}
+	if err != nil {
+		room.do(room.reset)
+		return err
+	}
+
+	room.do(room.moved)
+	log.Printf("migrated room %q to %s", roomName, to)
+	return nil
+}
+
+func sendRoomData(host string, data *RoomData) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("http://%s/admin/rooms/%s/data", host, url.PathEscape(data.RoomName))
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAdminToken(req)
+
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s %s", u, res.Status, b)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /admin/rooms/{room_name}/migrate?to={host}
+// 部屋を担当しているホストに送ること
+func postMigrateRoomHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		writeAdminError(w, http.StatusBadRequest, "to is required")
+		return
+	}
+
+	err := migrateRoom(roomName, to)
+	if err == errNotRoomOwner {
+		writeAdminError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeAdminError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, struct {
+		RoomName string `json:"room_name"`
+		Host     string `json:"host"`
+	}{roomName, to})
+}
+
+// PUT /admin/rooms/{room_name}/data
+// 移動元から送られた部屋のデータで gameStore を置き換える
+func putRoomDataHandler(w http.ResponseWriter, r *http.Request) {
+	roomName := mux.Vars(r)["room_name"]
+
+	var data RoomData
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || data.RoomName != roomName {
+		writeAdminError(w, http.StatusBadRequest, "invalid room data")
+		return
+	}
+
+	// 前にこのホストにあったときの状態が残っていれば捨てる
+	room := joinGameRoom(roomName)
+	defer room.leave()
+	room.do(func() {
+		err = importRoom(gameStore, &data)
+		room.reset()
+	})
+	if isInvalidCatalog(err) {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,20 +1,188 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"github.com/jmoiron/sqlx"
+	"gopkg.in/yaml.v2"
 )
 
-var MasterItems map[int]*mItem
+// loadMasterItems は config.MasterItems のファイルから、空の場合は MySQL の m_item からマスタを読み込む
+func loadMasterItems() (map[int]*mItem, error) {
+	var items []*mItem
+	var err error
+	if config.MasterItems != "" {
+		items, err = loadMasterItemsFile(config.MasterItems)
+	} else {
+		items, err = loadMasterItemsDB(db)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return masterItemsByID(items)
+}
 
-func initMasterItems(db *sqlx.DB) {
-	mItems := map[int]*mItem{}
+func loadMasterItemsDB(db *sqlx.DB) ([]*mItem, error) {
 	var items []*mItem
 	err := db.Select(&items, "SELECT * FROM m_item")
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return items, nil
+}
+
+// masterItemsByID は ItemID ごとのマップにする。ItemID が重複していたり正でない場合は誤り
+func masterItemsByID(items []*mItem) (map[int]*mItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no items")
 	}
+	mItems := map[int]*mItem{}
 	for _, item := range items {
+		if item.ItemID <= 0 {
+			return nil, fmt.Errorf("invalid item_id %d", item.ItemID)
+		}
+		if _, ok := mItems[item.ItemID]; ok {
+			return nil, fmt.Errorf("duplicate item_id %d", item.ItemID)
+		}
 		mItems[item.ItemID] = item
 	}
-	MasterItems = mItems
+	return mItems, nil
+}
+
+// loadMasterItemsFile は拡張子で形式を選んでマスタを読み込む。
+//
+//	.json, .yaml: m_item のカラム名と power_formula, price_formula, synergy をキーにしたオブジェクトの配列
+//	.csv: m_item のカラム名のヘッダ行とデータ行。power_formula, price_formula, synergy の列には JSON を書く
+//	.sql: db/m_item.sql の INSERT INTO m_item VALUES (...) 文
+//
+// power_formula, price_formula, synergy を指定できるのは .json, .yaml, .csv だけ。
+// linear と polynomial の coef は定数項から順に書く ({kind: linear, coef: [b, a]} は b + a*x)
+func loadMasterItemsFile(path string) ([]*mItem, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*mItem
+	switch filepath.Ext(path) {
+	case ".json":
+		err = json.Unmarshal(data, &items)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &items)
+	case ".csv":
+		items, err = parseMasterItemsCSV(string(data))
+	case ".sql":
+		items, err = parseMasterItemsSQL(string(data))
+	default:
+		err = fmt.Errorf("unsupported format")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return items, nil
+}
+
+var mItemColumns = []string{"item_id", "power1", "power2", "power3", "power4", "price1", "price2", "price3", "price4"}
+
+// newMItem は mItemColumns の順の値から mItem を作る
+func newMItem(values []string) (*mItem, error) {
+	if len(values) != len(mItemColumns) {
+		return nil, fmt.Errorf("want %d values, got %d", len(mItemColumns), len(values))
+	}
+	n := make([]int64, len(values))
+	for i, v := range values {
+		x, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not an integer", mItemColumns[i], v)
+		}
+		n[i] = x
+	}
+	return &mItem{
+		ItemID: int(n[0]),
+		Power1: n[1], Power2: n[2], Power3: n[3], Power4: n[4],
+		Price1: n[5], Price2: n[6], Price3: n[7], Price4: n[8],
+	}, nil
+}
+
+func parseMasterItemsCSV(data string) ([]*mItem, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no header")
+	}
+
+	// ヘッダの順にかかわらず mItemColumns の順に並べ替える
+	index := map[string]int{}
+	for i, name := range records[0] {
+		index[strings.TrimSpace(name)] = i
+	}
+	for _, name := range mItemColumns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	items := []*mItem{}
+	for line, record := range records[1:] {
+		values := make([]string, len(mItemColumns))
+		for i, name := range mItemColumns {
+			values[i] = record[index[name]]
+		}
+		item, err := newMItem(values)
+		if err == nil {
+			err = parseJSONColumn(record, index, "power_formula", &item.PowerFormula)
+		}
+		if err == nil {
+			err = parseJSONColumn(record, index, "price_formula", &item.PriceFormula)
+		}
+		if err == nil {
+			err = parseJSONColumn(record, index, "synergy", &item.Synergy)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line+2, err)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// parseJSONColumn は CSV の列 name に JSON があれば v に読み込む
+func parseJSONColumn(record []string, index map[string]int, name string, v interface{}) error {
+	i, ok := index[name]
+	if !ok || strings.TrimSpace(record[i]) == "" {
+		return nil
+	}
+	err := json.Unmarshal([]byte(record[i]), v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+var (
+	mItemInsertRe = regexp.MustCompile("(?is)INSERT\\s+INTO\\s+`?m_item`?\\s+VALUES\\s*(.*?);")
+	mItemRowRe    = regexp.MustCompile(`\(([^()]*)\)`)
+)
+
+func parseMasterItemsSQL(data string) ([]*mItem, error) {
+	items := []*mItem{}
+	for _, stmt := range mItemInsertRe.FindAllStringSubmatch(data, -1) {
+		for _, row := range mItemRowRe.FindAllStringSubmatch(stmt[1], -1) {
+			item, err := newMItem(strings.Split(row[1], ","))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", row[0], err)
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
 }
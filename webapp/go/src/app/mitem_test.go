@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMasterItemsFile(t *testing.T) {
+	assert := assert.New(t)
+
+	items, err := loadMasterItemsFile("../../../../db/m_item.sql")
+	assert.Nil(err)
+	assert.Len(items, 13)
+	assert.Equal(&mItem{ItemID: 3, Power1: 1, Power2: 10, Power3: 0, Power4: 2, Price1: 1, Price2: 3, Price3: 1, Price4: 2}, items[2])
+
+	dir, err := ioutil.TempDir("", "mitem")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"items.json": `[{"item_id": 3, "power1": 1, "power2": 10, "power3": 0, "power4": 2, "price1": 1, "price2": 3, "price3": 1, "price4": 2}]`,
+		"items.yaml": "- {item_id: 3, power1: 1, power2: 10, power3: 0, power4: 2, price1: 1, price2: 3, price3: 1, price4: 2}\n",
+		"items.csv":  "price4,price3,price2,price1,power4,power3,power2,power1,item_id\n2,1,3,1,2,0,10,1,3\n",
+		"items.sql":  "INSERT INTO `m_item` VALUES (3, 1, 10, 0, 2, 1, 3, 1, 2);\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		assert.Nil(ioutil.WriteFile(path, []byte(data), 0644))
+		got, err := loadMasterItemsFile(path)
+		assert.Nil(err, name)
+		assert.Equal(items[2:3], got, name)
+	}
+
+	path := filepath.Join(dir, "broken.csv")
+	assert.Nil(ioutil.WriteFile(path, []byte("item_id,power1\n1,2\n"), 0644))
+	_, err = loadMasterItemsFile(path)
+	assert.NotNil(err)
+
+	_, err = masterItemsByID([]*mItem{{ItemID: 1}, {ItemID: 1}})
+	assert.NotNil(err)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, v := range []interface{}{
+		nil, true, false, "", "isu", string(make([]byte, 40)), string(make([]byte, 300)),
+		int64(0), int64(127), int64(128), int64(70000), int64(1) << 40,
+		int64(-1), int64(-33), int64(-200), int64(-40000), int64(-1) << 40,
+	} {
+		b, err := marshalMsgpack(v)
+		assert.Nil(err)
+		x, err := unmarshalMsgpack(b)
+		assert.Nil(err)
+		assert.Equal(v, x)
+	}
+}
+
+func TestMsgpackStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	status := &GameStatus{
+		Time:     100,
+		Adding:   []*Adding{&Adding{RoomName: "r", Time: 200, Isu: "3"}},
+		Schedule: []Schedule{Schedule{Time: 100, MilliIsu: Exponential{123, 4}, TotalPower: Exponential{-1, 0}}},
+		Items:    []Item{},
+		OnSale:   nil,
+	}
+	b, err := marshalMsgpack(status)
+	assert.Nil(err)
+	x, err := unmarshalMsgpack(b)
+	assert.Nil(err)
+
+	assert.Equal(map[string]interface{}{
+		"time":     int64(100),
+		"adding":   []interface{}{map[string]interface{}{"time": int64(200), "isu": "3"}},
+		"schedule": []interface{}{map[string]interface{}{"time": int64(100), "milli_isu": []interface{}{int64(123), int64(4)}, "total_power": []interface{}{int64(-1), int64(0)}}},
+		"items":    []interface{}{},
+		"on_sale":  nil,
+	}, x)
+
+	// omitempty
+	b, err = marshalMsgpack(newGameResponse(1, nil))
+	assert.Nil(err)
+	x, err = unmarshalMsgpack(b)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{"request_id": int64(1), "is_success": true}, x)
+}
+
+func TestMsgpackRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := marshalMsgpack(GameRequest{RequestID: 5, Action: "buyItem", Time: 1000, ItemID: 3, CountBought: 2})
+	assert.Nil(err)
+	msg := parseGameMessage(msgpackCodec{}, b)
+	assert.Nil(msg.err)
+	assert.Equal(GameRequest{RequestID: 5, Action: "buyItem", Time: 1000, ItemID: 3, CountBought: 2}, msg.req)
+
+	msg = parseGameMessage(msgpackCodec{}, b[:len(b)-1])
+	assert.Equal(ErrMalformedRequest, msg.err)
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	assert := assert.New(t)
+
+	nested := func(depth int) []byte {
+		b := bytes.Repeat([]byte{0x91}, depth)
+		return append(b, 0xc0)
+	}
+	_, err := unmarshalMsgpack(nested(msgpackMaxDepth))
+	assert.Nil(err)
+	_, err = unmarshalMsgpack(nested(msgpackMaxDepth + 1))
+	assert.Equal(errMsgpackDeep, err)
+}
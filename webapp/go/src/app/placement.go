@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// 部屋をどのホストに割り当てるか。
+// 各ホストは host:heartbeat (共有 Redis の sorted set, スコアは unix ミリ秒) に定期的に書き込み、
+// hostTTL の間書き込みが無いホストは死んだとみなして host:heartbeat と host:member_count から消す。
+// 部屋の割り当ては host:room に保存する。割り当て先が死んでいる場合は生きているホストに割り当て直す。
+// gameStore を共有していない場合、死んだホストにあった部屋のデータは引き継がれない。
+// 停止するときは host:heartbeat を残すので、hostTTL の間に再起動すれば部屋はそのホストに残る。
+
+const (
+	placementLeastLoaded = "least-loaded" // 接続数が最も少ないホスト
+	placementHash        = "hash"         // 部屋名による rendezvous hashing
+)
+
+var (
+	// 自分のホスト名。webHosts の要素と同じ形式 (host:port)
+	selfHost          string
+	placementStrategy string
+
+	heartbeatInterval time.Duration
+	hostTTL           time.Duration
+
+	heartbeatQuit = make(chan struct{})
+)
+
+// 割り当て先が ARGV[2] (空文字列は未割り当て) のままの場合だけ ARGV[3] に割り当てる。割り当て先を返す
+var assignHostScript = redis.NewScript(1, `
+local cur = redis.call("HGET", KEYS[1], ARGV[1])
+if (not cur and ARGV[2] == "") or cur == ARGV[2] then
+  redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+  return ARGV[3]
+end
+return cur
+`)
+
+// ARGV[1] 以前にしか heartbeat の無いホストを消す。消したホストを返す
+var removeStaleHostsScript = redis.NewScript(2, `
+local stale = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+for _, h in ipairs(stale) do
+  redis.call("ZREM", KEYS[1], h)
+  redis.call("ZREM", KEYS[2], h)
+end
+return stale
+`)
+
+// initPlacement は config.Placement で割り当て方を選び、heartbeat を開始する。
+// 自分のホスト名は config.SelfHost か、無ければ os.Hostname() に一致する webHosts の要素を使う
+func initPlacement() {
+	placementStrategy = config.Placement.Strategy
+	heartbeatInterval = time.Duration(config.Placement.HeartbeatIntervalMS) * time.Millisecond
+	hostTTL = time.Duration(config.Placement.HostTTLMS) * time.Millisecond
+
+	selfHost = config.SelfHost
+	if selfHost == "" {
+		selfHost = guessSelfHost()
+	}
+	log.Printf("placement: %s self=%q", placementStrategy, selfHost)
+	if selfHost == "" {
+		return
+	}
+
+	err := heartbeat()
+	if err != nil {
+		log.Println(err)
+	}
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := heartbeat()
+				if err != nil {
+					log.Println(err)
+				}
+			case <-heartbeatQuit:
+				return
+			}
+		}
+	}()
+}
+
+func guessSelfHost() string {
+	name, err := os.Hostname()
+	if err != nil {
+		log.Println(err)
+		return ""
+	}
+	for _, h := range webHosts {
+		host, _, err := net.SplitHostPort(h)
+		if err != nil {
+			host = h
+		}
+		if host == name || strings.HasPrefix(host, name+".") {
+			return h
+		}
+	}
+	return ""
+}
+
+// heartbeat は自分が生きていることを書き込み、死んだホストを消す
+func heartbeat() error {
+	conn := sharedRedisPool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	_, err := conn.Do("ZADD", "host:heartbeat", unixMilli(now), selfHost)
+	if err != nil {
+		return err
+	}
+	stale, err := redis.Strings(removeStaleHostsScript.Do(conn,
+		"host:heartbeat", "host:member_count", unixMilli(now.Add(-hostTTL))))
+	if err != nil {
+		return err
+	}
+	if len(stale) > 0 {
+		log.Println("removed stale hosts", stale)
+	}
+	return nil
+}
+
+// leavePlacement は heartbeat を止める。再起動した後も同じ部屋を担当するよう、host:heartbeat と部屋の割り当ては残す
+func leavePlacement() {
+	if selfHost == "" {
+		return
+	}
+	close(heartbeatQuit)
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// liveHosts は生きているホストを返す。heartbeat を書いているホストが無い場合は ISU_WEB_HOSTS を全て返す
+func liveHosts(conn redis.Conn) ([]string, error) {
+	hosts, err := redis.Strings(conn.Do("ZRANGEBYSCORE", "host:heartbeat",
+		unixMilli(time.Now().Add(-hostTTL)), "+inf"))
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return webHosts, nil
+	}
+	return hosts, nil
+}
+
+// isRoomHostedHere は部屋が自分に割り当てられているか、まだ誰にも割り当てられていない場合に true を返す。
+// 自分のホスト名が分からない場合は確かめようがないので true を返す
+func isRoomHostedHere(room string) (bool, error) {
+	if selfHost == "" {
+		return true, nil
+	}
+	conn := sharedRedisPool.Get()
+	defer conn.Close()
+
+	current, err := redis.String(conn.Do("HGET", "host:room", room))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	return current == "" || current == selfHost, nil
+}
+
+// keepsHost は部屋を今の割り当て先 current のままにするかどうかを返す。
+// 死んだホストには接続できないので、gameStore を共有していなくても割り当て直す
+func keepsHost(current string, live []string) bool {
+	return current != "" && containsString(live, current)
+}
+
+// getHostFromRoomName は部屋を担当するホストを返す。
+// まだ割り当てられていない場合と、割り当て先が死んでいる場合は生きているホストに割り当てる
+func getHostFromRoomName(room string) (string, error) {
+	conn := sharedRedisPool.Get()
+	defer conn.Close()
+
+	live, err := liveHosts(conn)
+	if err != nil {
+		return "", err
+	}
+
+	current, err := redis.String(conn.Do("HGET", "host:room", room))
+	if err != nil && err != redis.ErrNil {
+		return "", err
+	}
+	if keepsHost(current, live) {
+		return current, nil
+	}
+
+	var host string
+	switch placementStrategy {
+	case placementHash:
+		host = pickRendezvous(live, room)
+	default:
+		counts, err := redis.Int64Map(conn.Do("ZRANGE", "host:member_count", 0, -1, "WITHSCORES"))
+		if err != nil {
+			return "", err
+		}
+		host = pickLeastLoaded(live, counts)
+	}
+	if host == "" {
+		return "", fmt.Errorf("no live host for room %q", room)
+	}
+	if current != "" {
+		log.Printf("reassigning room %q from %s to %s", room, current, host)
+		if !gameStore.Shared() {
+			log.Printf("room %q loses the data stored on %s", room, current)
+		}
+	}
+
+	// 同時に割り当てられた場合は先に書き込まれた方を使う
+	return redis.String(assignHostScript.Do(conn, "host:room", room, current, host))
+}
+
+// pickLeastLoaded は接続数が最も少ないホストを返す。同じ場合は名前順で最初のもの
+func pickLeastLoaded(hosts []string, counts map[string]int64) string {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	best := ""
+	for _, h := range sorted {
+		if best == "" || counts[h] < counts[best] {
+			best = h
+		}
+	}
+	return best
+}
+
+// pickRendezvous は部屋とホストの組のハッシュが最大のホストを返す。
+// ホストが増減しても、そのホストに割り当てられていた部屋以外は割り当て先が変わらない
+func pickRendezvous(hosts []string, room string) string {
+	best := ""
+	var bestWeight uint64
+	for _, h := range hosts {
+		f := fnv.New64a()
+		f.Write([]byte(h))
+		f.Write([]byte{0})
+		f.Write([]byte(room))
+		w := f.Sum64()
+		if best == "" || w > bestWeight || (w == bestWeight && h < best) {
+			best, bestWeight = h, w
+		}
+	}
+	return best
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickLeastLoaded(t *testing.T) {
+	assert := assert.New(t)
+
+	hosts := []string{"c:5000", "a:5000", "b:5000"}
+	assert.Equal("b:5000", pickLeastLoaded(hosts, map[string]int64{"a:5000": 3, "b:5000": 1, "c:5000": 2}))
+	// 同じ場合は名前順
+	assert.Equal("a:5000", pickLeastLoaded(hosts, map[string]int64{"a:5000": 1, "b:5000": 1, "c:5000": 1}))
+	// host:member_count に無いホストは 0 とみなす
+	assert.Equal("c:5000", pickLeastLoaded(hosts, map[string]int64{"a:5000": 1, "b:5000": 1}))
+	assert.Equal("", pickLeastLoaded(nil, nil))
+}
+
+func TestPickRendezvous(t *testing.T) {
+	assert := assert.New(t)
+
+	hosts := []string{"a:5000", "b:5000", "c:5000", "d:5000"}
+	assigned := map[string]string{}
+	for i := 0; i < 100; i++ {
+		room := fmt.Sprintf("room%d", i)
+		assigned[room] = pickRendezvous(hosts, room)
+		assert.Equal(assigned[room], pickRendezvous([]string{"d:5000", "c:5000", "b:5000", "a:5000"}, room))
+	}
+
+	// c が死んでも c 以外に割り当てられていた部屋は動かない
+	live := []string{"a:5000", "b:5000", "d:5000"}
+	for room, host := range assigned {
+		h := pickRendezvous(live, room)
+		assert.NotEqual("c:5000", h)
+		if host != "c:5000" {
+			assert.Equal(host, h)
+		}
+	}
+}
+
+func TestKeepsHost(t *testing.T) {
+	assert := assert.New(t)
+	defer func(s GameStore) { gameStore = s }(gameStore)
+	gameStore = newMemoryGameStore()
+	assert.False(gameStore.Shared())
+
+	live := []string{"a:5000", "b:5000"}
+	assert.True(keepsHost("a:5000", live))
+	assert.False(keepsHost("", live))
+	// gameStore を共有していなくても死んだホストの部屋は割り当て直す
+	assert.False(keepsHost("dead:5000", live))
+}
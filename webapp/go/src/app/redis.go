@@ -1,7 +1,6 @@
 package main
 
 import (
-	"os"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -13,10 +12,7 @@ var (
 )
 
 func initRedisPool() {
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
-	}
+	redisURL := config.Redis.URL
 	redisPool = &redis.Pool{
 		MaxIdle:     100,
 		IdleTimeout: 10 * 60 * time.Second,
@@ -25,14 +21,8 @@ func initRedisPool() {
 			return redis.DialURL(redisURL)
 		},
 	}
-	conn := redisPool.Get()
-	defer conn.Close()
-	conn.Do("FLUSHALL")
 
-	sharedRedisURL := os.Getenv("SHARED_REDIS_URL")
-	if sharedRedisURL == "" {
-		sharedRedisURL = "redis://localhost:6379"
-	}
+	sharedRedisURL := config.Redis.SharedURL
 	sharedRedisPool = &redis.Pool{
 		MaxIdle:     100,
 		IdleTimeout: 10 * 60 * time.Second,
@@ -41,8 +31,4 @@ func initRedisPool() {
 			return redis.DialURL(sharedRedisURL)
 		},
 	}
-
-	sharedconn := sharedRedisPool.Get()
-	defer sharedconn.Close()
-	sharedconn.Do("DEL", "host:member_count")
 }
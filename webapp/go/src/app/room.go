@@ -1,43 +1,39 @@
 package main
 
-import "github.com/garyburd/redigo/redis"
+import "log"
+
+// addMemberToRoom は部屋への接続を数え、数えたホストを返す。接続が終わったら leaveMemberToRoom に渡すこと。
+// 部屋の割り当て先は途中で変わることがあるので、自分のホスト名が分かる場合は自分を数える
+func addMemberToRoom(room string) string {
+	host := selfHost
+	if host == "" {
+		var err error
+		host, err = getHostFromRoomName(room)
+		if err != nil {
+			log.Println(err)
+			return ""
+		}
+	}
 
-func addMemberToRoom(room string) {
 	conn := sharedRedisPool.Get()
 	defer conn.Close()
 
-	host := getHostFromRoomName(room)
 	conn.Do("ZINCRBY", "host:member_count", 1, host)
+	return host
 }
 
-func leaveMemberToRoom(room string) {
-	conn := sharedRedisPool.Get()
-	defer conn.Close()
-
-	host := getHostFromRoomName(room)
-	conn.Do("ZINCRBY", "host:member_count", -1, host)
-}
+func leaveMemberToRoom(host string) {
+	if host == "" {
+		return
+	}
 
-func getHostFromRoomName(room string) string {
 	conn := sharedRedisPool.Get()
 	defer conn.Close()
 
-	host, err := redis.String(conn.Do("HGET", "host:room", room))
-	if err != nil {
-		if err == redis.ErrNil {
-			hosts, err := redis.Strings(conn.Do("ZRANGE", "host:member_count", 0, 1))
-			if err != nil {
-				panic(err)
-			}
-			host := hosts[0]
-			conn.Do("HSET", "host:room", room, host)
-			return host
-		}
-		panic(err)
-	}
-	return host
+	conn.Do("ZINCRBY", "host:member_count", -1, host)
 }
 
+// initRoom はホストの接続数を用意する。他のホストの接続数は残し、自分の接続数は 0 に戻す
 func initRoom() {
 	conn := sharedRedisPool.Get()
 	defer conn.Close()
@@ -48,7 +44,13 @@ func initRoom() {
 		panic(err)
 	}
 	for _, h := range webHosts {
-		err = conn.Send("ZADD", "host:member_count", 0, h)
+		err = conn.Send("ZADD", "host:member_count", "NX", 0, h)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if selfHost != "" {
+		err = conn.Send("ZADD", "host:member_count", 0, selfHost)
 		if err != nil {
 			panic(err)
 		}
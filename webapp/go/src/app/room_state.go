@@ -0,0 +1,401 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+)
+
+// roomState は部屋のゲーム状態を time 時点まで畳み込んだもの。
+// time より先の Adding/Buying は pending として保持し、その時刻になったら畳み込む。
+type roomState struct {
+	roomName string
+	mItems   map[int]*mItem
+	time     int64
+
+	totalIsu   *big.Int // time までに加算された isu の合計
+	milliIsu   *big.Int // time における milli isu
+	totalPower *big.Int // time における相乗効果を掛けた power の合計
+
+	itemBought map[int]int      // ItemID => CountBought
+	itemBuilt  map[int]int      // ItemID => time における BuiltCount
+	itemPower  map[int]*big.Int // ItemID => time における相乗効果を掛ける前の Power
+
+	multipliers map[int]*big.Int // ItemID => time における相乗効果の倍率。1 のアイテムは含まない
+
+	addingAt map[int64]*big.Int // Time => time より先の Adding
+	buyings  []*Buying          // time より先の Buying (Time 昇順)
+
+	// totalIsu が更新されたが gameStore にまだ反映していない
+	addingDirty bool
+}
+
+func newRoomState(roomName string, mItems map[int]*mItem, currentTime int64) *roomState {
+	s := &roomState{
+		roomName:   roomName,
+		mItems:     mItems,
+		time:       currentTime,
+		totalIsu:   big.NewInt(0),
+		milliIsu:   big.NewInt(0),
+		totalPower: big.NewInt(0),
+		itemBought: map[int]int{},
+		itemBuilt:  map[int]int{},
+		itemPower:  map[int]*big.Int{},
+
+		multipliers: map[int]*big.Int{},
+		addingAt:    map[int64]*big.Int{},
+	}
+	for itemID := range mItems {
+		s.itemPower[itemID] = big.NewInt(0)
+	}
+	return s
+}
+
+// addAdding は t に isu を加算する Adding を反映する
+func (s *roomState) addAdding(t int64, isu *big.Int) {
+	if t <= s.time {
+		s.totalIsu.Add(s.totalIsu, isu)
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(isu, bi1000))
+		s.addingDirty = true
+		return
+	}
+	if a, ok := s.addingAt[t]; ok {
+		a.Add(a, isu)
+	} else {
+		s.addingAt[t] = new(big.Int).Set(isu)
+	}
+}
+
+// addBuying は Buying を反映する。
+// buying は 即座に isu を消費し buying.time からアイテムの効果を発揮する
+func (s *roomState) addBuying(b *Buying) {
+	m := s.mItems[b.ItemID]
+	s.itemBought[b.ItemID]++
+	s.milliIsu.Sub(s.milliIsu, new(big.Int).Mul(m.GetPrice(b.Ordinal), bi1000))
+	s.placeBuying(b)
+}
+
+// addBuyings は新しい状態に部屋の全ての Buying を反映する。
+// アイテムごとに 1 から順に買っているので、消費した isu はアイテムごとに TotalPrice でまとめて引く
+func (s *roomState) addBuyings(buyings []*Buying) {
+	for _, b := range buyings {
+		s.itemBought[b.ItemID]++
+	}
+	for itemID, n := range s.itemBought {
+		s.milliIsu.Sub(s.milliIsu, new(big.Int).Mul(s.mItems[itemID].TotalPrice(n), bi1000))
+	}
+	for _, b := range buyings {
+		s.placeBuying(b)
+	}
+}
+
+// placeBuying は消費済みの Buying のアイテムを建てる。b.Time が time より先なら pending にする
+func (s *roomState) placeBuying(b *Buying) {
+	if b.Time <= s.time {
+		// b.Time から time まで増えた power の分を足す。Buying は時刻順に反映すること
+		before := s.totalPower
+		s.build(b)
+		power := new(big.Int).Sub(s.totalPower, before)
+		s.milliIsu.Add(s.milliIsu, power.Mul(power, big.NewInt(s.time-b.Time)))
+		return
+	}
+	i := sort.Search(len(s.buyings), func(i int) bool { return s.buyings[i].Time > b.Time })
+	s.buyings = append(s.buyings, nil)
+	copy(s.buyings[i+1:], s.buyings[i:])
+	s.buyings[i] = b
+}
+
+func (s *roomState) build(b *Buying) {
+	power := s.mItems[b.ItemID].GetPower(b.Ordinal)
+	s.itemBuilt[b.ItemID]++
+	delta := addPower(s.mItems, s.itemPower, s.multipliers, b.ItemID, power)
+	s.totalPower = delta.Add(delta, s.totalPower)
+}
+
+// advance は t までに発生する Adding/Buying を畳み込み、状態を時刻 t に進める
+func (s *roomState) advance(t int64) {
+	if t <= s.time {
+		return
+	}
+	for {
+		next, ok := s.nextEventTime()
+		if !ok || next > t {
+			break
+		}
+		s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(s.totalPower, big.NewInt(next-s.time)))
+		s.time = next
+		if isu, ok := s.addingAt[next]; ok {
+			delete(s.addingAt, next)
+			s.addAdding(next, isu)
+		}
+		for len(s.buyings) > 0 && s.buyings[0].Time == next {
+			s.build(s.buyings[0])
+			s.buyings = s.buyings[1:]
+		}
+	}
+	s.milliIsu.Add(s.milliIsu, new(big.Int).Mul(s.totalPower, big.NewInt(t-s.time)))
+	s.time = t
+}
+
+func (s *roomState) nextEventTime() (int64, bool) {
+	var next int64
+	ok := false
+	for t := range s.addingAt {
+		if !ok || t < next {
+			next, ok = t, true
+		}
+	}
+	if len(s.buyings) > 0 && (!ok || s.buyings[0].Time < next) {
+		next, ok = s.buyings[0].Time, true
+	}
+	return next, ok
+}
+
+// milliIsuAt は状態を変えずに時刻 t (>= s.time) における milli isu を計算する
+func (s *roomState) milliIsuAt(t int64) *big.Int {
+	milliIsu := new(big.Int).Set(s.milliIsu)
+	if t <= s.time {
+		return milliIsu
+	}
+	for at, isu := range s.addingAt {
+		if at <= t {
+			milliIsu.Add(milliIsu, new(big.Int).Mul(isu, bi1000))
+		}
+	}
+
+	// t までに建つアイテムは相乗効果で他のアイテムの power も変えるので、建つたびに合計を更新する
+	var (
+		prev        = s.time
+		totalPower  = s.totalPower
+		itemPower   map[int]*big.Int
+		multipliers map[int]*big.Int
+	)
+	for _, b := range s.buyings {
+		if b.Time > t {
+			break
+		}
+		if itemPower == nil {
+			itemPower = copyPowers(s.itemPower)
+			multipliers = copyPowers(s.multipliers)
+		}
+		milliIsu.Add(milliIsu, new(big.Int).Mul(totalPower, big.NewInt(b.Time-prev)))
+		prev = b.Time
+		delta := addPower(s.mItems, itemPower, multipliers, b.ItemID, s.mItems[b.ItemID].GetPower(b.Ordinal))
+		totalPower = delta.Add(delta, totalPower)
+	}
+	milliIsu.Add(milliIsu, new(big.Int).Mul(totalPower, big.NewInt(t-prev)))
+	return milliIsu
+}
+
+func (s *roomState) calcStatus() (*GameStatus, error) {
+	var (
+		currentTime = s.time
+		mItems      = s.mItems
+
+		totalMilliIsu = new(big.Int).Set(s.milliIsu)
+		totalPower    = new(big.Int).Set(s.totalPower)
+
+		itemPower    = map[int]*big.Int{} // ItemID => 相乗効果を掛ける前の Power
+		multipliers  = copyPowers(s.multipliers)
+		boosted      = map[int]*big.Int{}    // ItemID => 相乗効果を掛けた Power
+		itemPrice    = map[int]*big.Int{}    // ItemID => Price
+		itemNeed     = map[int]*big.Int{}    // ItemID => Price * 1000
+		itemOnSale   = map[int]int64{}       // ItemID => OnSale
+		itemBuilt    = map[int]int{}         // ItemID => BuiltCount
+		itemBuilding = map[int][]Building{}  // ItemID => Buildings
+		itemPower0   = map[int]Exponential{} // ItemID => currentTime における Power
+		itemBuilt0   = map[int]int{}         // ItemID => currentTime における BuiltCount
+
+		buyingAt = map[int64][]*Buying{} // Time => currentTime より先の Buying
+	)
+
+	for itemID := range mItems {
+		itemPower[itemID] = new(big.Int).Set(s.itemPower[itemID])
+		itemBuilt[itemID] = s.itemBuilt[itemID]
+		itemBuilding[itemID] = []Building{}
+	}
+	for _, b := range s.buyings {
+		buyingAt[b.Time] = append(buyingAt[b.Time], b)
+	}
+
+	for _, m := range mItems {
+		boosted[m.ItemID] = boostPower(multipliers, m.ItemID, itemPower[m.ItemID])
+		itemPower0[m.ItemID] = big2exp(boosted[m.ItemID])
+		itemBuilt0[m.ItemID] = itemBuilt[m.ItemID]
+		price := m.GetPrice(s.itemBought[m.ItemID] + 1)
+		itemPrice[m.ItemID] = price
+		itemNeed[m.ItemID] = new(big.Int).Mul(price, bi1000)
+		if 0 <= totalMilliIsu.Cmp(itemNeed[m.ItemID]) {
+			itemOnSale[m.ItemID] = 0 // 0 は 時刻 currentTime で購入可能であることを表す
+		}
+	}
+
+	schedule := []Schedule{
+		Schedule{
+			Time:       currentTime,
+			MilliIsu:   big2exp(totalMilliIsu),
+			TotalPower: big2exp(totalPower),
+		},
+	}
+
+	// currentTime から config.Game.HorizonMS ミリ秒先までシミュレーションする。
+	// adding/buying の発生しない区間では milli isu は線形に増えるので、
+	// 購入可能になる時刻は区間ごとに割り算で求める
+	endTime := currentTime + int64(config.Game.HorizonMS)
+	eventTimes := []int64{}
+	for t := range s.addingAt {
+		if t <= endTime {
+			eventTimes = append(eventTimes, t)
+		}
+	}
+	for t := range buyingAt {
+		if _, ok := s.addingAt[t]; !ok && t <= endTime {
+			eventTimes = append(eventTimes, t)
+		}
+	}
+	sort.Slice(eventTimes, func(i, j int) bool { return eventTimes[i] < eventTimes[j] })
+
+	// (prev, to] の間に購入可能になったアイテムを記録する
+	prev := currentTime
+	findOnSale := func(to int64) {
+		for itemID := range mItems {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if t, ok := reachTime(totalMilliIsu, totalPower, itemNeed[itemID], prev, to); ok {
+				itemOnSale[itemID] = t
+			}
+		}
+	}
+
+	for _, t := range eventTimes {
+		findOnSale(t - 1)
+		totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(totalPower, big.NewInt(t-prev)))
+		prev = t
+
+		// 時刻 t で発生する adding を計算する
+		if isu, ok := s.addingAt[t]; ok {
+			totalMilliIsu.Add(totalMilliIsu, new(big.Int).Mul(isu, bi1000))
+		}
+
+		// 時刻 t で発生する buying を計算する
+		// 相乗効果で power が変わったアイテムも Building に加える
+		if _, ok := buyingAt[t]; ok {
+			updatedID := map[int]bool{}
+			synergy := false
+			for _, b := range buyingAt[t] {
+				m := mItems[b.ItemID]
+				updatedID[b.ItemID] = true
+				synergy = synergy || hasSynergy(m)
+				itemBuilt[b.ItemID]++
+				delta := addPower(mItems, itemPower, multipliers, b.ItemID, m.GetPower(b.Ordinal))
+				totalPower = delta.Add(delta, totalPower)
+			}
+			// 相乗効果のあるアイテムが建たなければ、power が変わるのは建てたアイテムだけ
+			for id := range mItems {
+				if !updatedID[id] && !synergy {
+					continue
+				}
+				next := boostPower(multipliers, id, itemPower[id])
+				if updatedID[id] || next.Cmp(boosted[id]) != 0 {
+					itemBuilding[id] = append(itemBuilding[id], Building{
+						Time:       t,
+						CountBuilt: itemBuilt[id],
+						Power:      big2exp(next),
+					})
+				}
+				boosted[id] = next
+			}
+		}
+
+		schedule = append(schedule, Schedule{
+			Time:       t,
+			MilliIsu:   big2exp(totalMilliIsu),
+			TotalPower: big2exp(totalPower),
+		})
+
+		// 時刻 t で購入可能になったアイテムを記録する
+		for itemID := range mItems {
+			if _, ok := itemOnSale[itemID]; ok {
+				continue
+			}
+			if 0 <= totalMilliIsu.Cmp(itemNeed[itemID]) {
+				itemOnSale[itemID] = t
+			}
+		}
+	}
+	findOnSale(endTime)
+
+	gsAdding := []*Adding{}
+	for t, isu := range s.addingAt {
+		gsAdding = append(gsAdding, &Adding{RoomName: s.roomName, Time: t, Isu: isu.String()})
+	}
+
+	gsItems := []Item{}
+	for itemID, _ := range mItems {
+		gsItems = append(gsItems, Item{
+			ItemID:      itemID,
+			CountBought: s.itemBought[itemID],
+			CountBuilt:  itemBuilt0[itemID],
+			NextPrice:   big2exp(itemPrice[itemID]),
+			Power:       itemPower0[itemID],
+			Building:    itemBuilding[itemID],
+		})
+	}
+
+	gsOnSale := []OnSale{}
+	for itemID, t := range itemOnSale {
+		gsOnSale = append(gsOnSale, OnSale{
+			ItemID: itemID,
+			Time:   t,
+		})
+	}
+
+	return &GameStatus{
+		Adding:   gsAdding,
+		Schedule: schedule,
+		Items:    gsItems,
+		OnSale:   gsOnSale,
+	}, nil
+}
+
+func loadRoomState(roomName string, mItems map[int]*mItem, currentTime int64) (*roomState, error) {
+	addings, err := listAllAddings(gameStore, roomName)
+	if err != nil {
+		return nil, err
+	}
+	buyings, err := gameStore.ListBuyings(roomName)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newRoomState(roomName, mItems, currentTime)
+	for _, a := range addings {
+		s.addAdding(a.Time, str2big(a.Isu))
+	}
+	s.addBuyings(buyings)
+	return s, nil
+}
+
+// reachTime は時刻 t0 に milliIsu で毎ミリ秒 power ずつ増えるとき、
+// (t0, t1] の中で最初に need 以上になる時刻を返す
+func reachTime(milliIsu, power, need *big.Int, t0, t1 int64) (int64, bool) {
+	if t1 <= t0 {
+		return 0, false
+	}
+	diff := new(big.Int).Sub(need, milliIsu)
+	if diff.Sign() <= 0 {
+		return t0 + 1, true
+	}
+	if power.Sign() <= 0 {
+		return 0, false
+	}
+	// dt = ceil(diff / power)
+	dt, r := new(big.Int).QuoRem(diff, power, new(big.Int))
+	if r.Sign() > 0 {
+		dt.Add(dt, big.NewInt(1))
+	}
+	if dt.Cmp(big.NewInt(t1-t0)) > 0 {
+		return 0, false
+	}
+	return t0 + dt.Int64(), true
+}
@@ -1,36 +1,67 @@
 package main
 
 import (
-	"log"
 	"time"
-
-	"github.com/jmoiron/sqlx"
 )
 
-var (
-	roomTimeByName map[string]int64
-)
+// 部屋の時刻は gameStore に書き込むので、再起動や別ホストに移っても巻き戻らない。
+// 書き込むのはアクションを記録するときだけで、GameStatus を配信するたびには書き込まない。
+// 配信した時刻は gameRoom.lastTime に覚えておき、アクションでもそれより前には戻さない
+
+// nowMilli は現在時刻 (unix ミリ秒)。テストでは差し替える
+var nowMilli = func() int64 {
+	return int64(time.Now().UnixNano()) / 1000000
+}
+
+// updateRoomTime は部屋の時刻を現在時刻に進め、gameStore に書き込む。
+// 部屋の goroutine から呼ぶこと
+func updateRoomTime(room *gameRoom, reqTime int64) (int64, error) {
+	currentTime, err := currentRoomTime(room, reqTime)
+	if err != nil {
+		return 0, err
+	}
+	err = saveRoomTime(room, currentTime)
+	if err != nil {
+		return 0, err
+	}
+	return currentTime, nil
+}
 
-func updateRoomTime(tx *sqlx.Tx, roomName string, reqTime int64) (int64, bool) {
-	roomTime := roomTimeByName[roomName]
+// currentRoomTime は部屋の時刻が巻き戻らないことを確かめて現在時刻を返す。
+// 返した時刻は room.lastTime に覚えるが、gameStore には書き込まない。
+// 部屋の goroutine から呼ぶこと
+func currentRoomTime(room *gameRoom, reqTime int64) (int64, error) {
+	if !room.roomTimeLoaded {
+		roomTime, err := gameStore.GetRoomTime(room.name)
+		if err != nil {
+			return 0, err
+		}
+		room.roomTime = roomTime
+		room.roomTimeLoaded = true
+	}
 
-	var currentTime int64 = int64(time.Now().UnixNano()) / 1000000
-	if roomTime > currentTime {
-		log.Println("room time is future")
-		return 0, false
+	currentTime := nowMilli()
+	if room.roomTime > currentTime || room.lastTime > currentTime {
+		return 0, ErrRoomTimeIsFuture
 	}
 	if reqTime != 0 {
 		if reqTime < currentTime {
-			log.Println("reqTime is past")
-			return 0, false
+			return 0, ErrReqTimeIsPast
 		}
 	}
-
-	roomTimeByName[roomName] = currentTime
-
-	return currentTime, true
+	room.lastTime = currentTime
+	return currentTime, nil
 }
 
-func initRoomTime() {
-	roomTimeByName = map[string]int64{}
+// saveRoomTime は部屋の時刻 t を gameStore に書き込む。部屋の goroutine から呼ぶこと
+func saveRoomTime(room *gameRoom, t int64) error {
+	if room.roomTimeLoaded && room.roomTime >= t {
+		return nil
+	}
+	err := gameStore.SetRoomTime(room.name, t)
+	if err != nil {
+		return err
+	}
+	room.roomTime = t
+	return nil
 }
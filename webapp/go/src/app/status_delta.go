@@ -0,0 +1,95 @@
+package main
+
+// delta プロトコル (/ws/{room_name}?protocol=delta) では GameStatus の代わりに
+// 最初に StatusSnapshot を送り、以降は前回との差分 StatusDelta を送る。
+//
+// クライアントは直前に受け取った GameStatus に StatusDelta を次のようにマージする。
+//   - Time, OnSale は置き換える
+//   - Schedule は Time が StatusDelta.Schedule[0].Time より前のものを捨ててから、同じ Time のものを置き換える
+//   - Adding は Time が StatusDelta.Schedule[0].Time 以下のものを捨ててから、同じ Time のものを置き換える
+//   - Items は同じ ItemID のものを置き換える
+//
+// Seq は部屋ごとの連番で、飛んだ場合や不整合がある場合は action: "resync" を送ると StatusSnapshot が届く。
+
+const (
+	statusTypeSnapshot = "snapshot"
+	statusTypeDelta    = "delta"
+)
+
+type StatusSnapshot struct {
+	Type   string      `json:"type"`
+	Seq    int64       `json:"seq"`
+	Status *GameStatus `json:"status"`
+}
+
+type StatusDelta struct {
+	Type     string     `json:"type"`
+	Seq      int64      `json:"seq"`
+	Time     int64      `json:"time"`
+	Adding   []*Adding  `json:"adding"`   // 追加または変更された Adding
+	Schedule []Schedule `json:"schedule"` // 追加または変更された Schedule。先頭は常に現在の Schedule
+	Items    []Item     `json:"items"`    // 変更された Item
+	OnSale   []OnSale   `json:"on_sale"`
+}
+
+func newStatusSnapshot(seq int64, status *GameStatus) *StatusSnapshot {
+	return &StatusSnapshot{Type: statusTypeSnapshot, Seq: seq, Status: status}
+}
+
+// diffGameStatus は prev から cur への差分を返す
+func diffGameStatus(seq int64, prev, cur *GameStatus) *StatusDelta {
+	delta := &StatusDelta{
+		Type:     statusTypeDelta,
+		Seq:      seq,
+		Time:     cur.Time,
+		Adding:   []*Adding{},
+		Schedule: []Schedule{},
+		Items:    []Item{},
+		OnSale:   cur.OnSale,
+	}
+
+	prevAdding := map[int64]string{}
+	for _, a := range prev.Adding {
+		prevAdding[a.Time] = a.Isu
+	}
+	for _, a := range cur.Adding {
+		if isu, ok := prevAdding[a.Time]; !ok || isu != a.Isu {
+			delta.Adding = append(delta.Adding, a)
+		}
+	}
+
+	prevSchedule := map[int64]Schedule{}
+	for _, s := range prev.Schedule {
+		prevSchedule[s.Time] = s
+	}
+	for i, s := range cur.Schedule {
+		if p, ok := prevSchedule[s.Time]; i == 0 || !ok || p != s {
+			delta.Schedule = append(delta.Schedule, s)
+		}
+	}
+
+	prevItems := map[int]Item{}
+	for _, item := range prev.Items {
+		prevItems[item.ItemID] = item
+	}
+	for _, item := range cur.Items {
+		if p, ok := prevItems[item.ItemID]; !ok || !equalItem(p, item) {
+			delta.Items = append(delta.Items, item)
+		}
+	}
+
+	return delta
+}
+
+func equalItem(a, b Item) bool {
+	if a.ItemID != b.ItemID || a.CountBought != b.CountBought || a.CountBuilt != b.CountBuilt ||
+		a.NextPrice != b.NextPrice || a.Power != b.Power || len(a.Building) != len(b.Building) {
+		return false
+	}
+	for i := range a.Building {
+		if a.Building[i] != b.Building[i] {
+			return false
+		}
+	}
+	return true
+}
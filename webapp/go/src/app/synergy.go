@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// 相乗効果のあるアイテムは、建てた数だけ対象のアイテム (target が 0 の場合は全てのアイテム) の power を factor 倍する。
+// 例えば factor 2 のアイテムを3つ建てると対象の power は 8 倍になる。
+// 部屋の状態ではアイテムごとの power を相乗効果を掛ける前の値で持ち、合計と出力には掛けた後の値を使う
+
+// SynergySpec はマスタに書く相乗効果
+type SynergySpec struct {
+	Target int   `json:"target" yaml:"target"`
+	Factor int64 `json:"factor" yaml:"factor"`
+}
+
+// hasSynergy は建てると power の倍率が変わるアイテムかどうかを返す
+func hasSynergy(m *mItem) bool {
+	return m.Synergy != nil && m.Synergy.Factor != 1
+}
+
+// boostPower は相乗効果を掛ける前の power に itemID の倍率を掛けた値を返す。
+// multipliers は ItemID => 倍率で、倍率が 1 のアイテムは含まない
+func boostPower(multipliers map[int]*big.Int, itemID int, power *big.Int) *big.Int {
+	if x, ok := multipliers[itemID]; ok {
+		return new(big.Int).Mul(power, x)
+	}
+	return new(big.Int).Set(power)
+}
+
+// addPower は itemID のアイテムが建ち、相乗効果を掛ける前の power が power だけ増えたことを itemPower に反映する。
+// 建てたアイテムに相乗効果があれば対象の倍率を factor 倍する。
+// 相乗効果を掛けた power の合計が増えた分を返す
+func addPower(mItems map[int]*mItem, itemPower, multipliers map[int]*big.Int, itemID int, power *big.Int) *big.Int {
+	itemPower[itemID].Add(itemPower[itemID], power)
+	delta := boostPower(multipliers, itemID, power)
+
+	m := mItems[itemID]
+	if !hasSynergy(m) {
+		return delta
+	}
+	f := big.NewInt(m.Synergy.Factor)
+	f1 := big.NewInt(m.Synergy.Factor - 1)
+	apply := func(target int) {
+		// 対象の今の power の factor-1 倍だけ合計が増える
+		delta.Add(delta, new(big.Int).Mul(boostPower(multipliers, target, itemPower[target]), f1))
+		if x, ok := multipliers[target]; ok {
+			x.Mul(x, f)
+		} else {
+			multipliers[target] = new(big.Int).Set(f)
+		}
+	}
+	if m.Synergy.Target != 0 {
+		apply(m.Synergy.Target)
+	} else {
+		for target := range mItems {
+			apply(target)
+		}
+	}
+	return delta
+}
+
+// copyPowers は ItemID => power (倍率) の map を値ごと複製する
+func copyPowers(powers map[int]*big.Int) map[int]*big.Int {
+	c := make(map[int]*big.Int, len(powers))
+	for id, p := range powers {
+		c[id] = new(big.Int).Set(p)
+	}
+	return c
+}
+
+// synergyProblems は相乗効果の誤りを返す
+func synergyProblems(m *mItem, items map[int]*mItem) []string {
+	if m.Synergy == nil {
+		return nil
+	}
+	problems := []string{}
+	if _, ok := items[m.Synergy.Target]; m.Synergy.Target != 0 && !ok {
+		problems = append(problems, fmt.Sprintf("item %d: synergy target item %d does not exist", m.ItemID, m.Synergy.Target))
+	}
+	if m.Synergy.Factor < 1 {
+		problems = append(problems, fmt.Sprintf("item %d: synergy factor %d is less than 1", m.ItemID, m.Synergy.Factor))
+	}
+	return problems
+}
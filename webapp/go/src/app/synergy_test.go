@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSynergy(t *testing.T) {
+	assert := assert.New(t)
+
+	free := &FormulaSpec{Kind: formulaLinear, Coef: []int64{0, 0}}
+	mItems := map[int]*mItem{
+		1: {ItemID: 1, PowerFormula: &FormulaSpec{Kind: formulaLinear, Coef: []int64{10, 0}}, PriceFormula: free},
+		2: {ItemID: 2, PowerFormula: free, PriceFormula: free, Synergy: &SynergySpec{Target: 1, Factor: 3}},
+		3: {ItemID: 3, PowerFormula: free, PriceFormula: free, Synergy: &SynergySpec{Target: 0, Factor: 2}},
+	}
+	assert.Nil(validateCatalog(mItems, nil))
+	assert.Nil(linkFormulas(mItems))
+
+	buyings := []*Buying{
+		{ItemID: 1, Ordinal: 1, Time: 0},
+		{ItemID: 2, Ordinal: 1, Time: 100},
+		{ItemID: 3, Ordinal: 1, Time: 300},
+	}
+	s := newRoomState("", mItems, 200)
+	for _, b := range buyings {
+		s.addBuying(b)
+	}
+	// 100 までは 10、100 からは 3 倍の 30
+	assert.Equal(0, big.NewInt(4000).Cmp(s.milliIsu))
+	assert.Equal(0, big.NewInt(30).Cmp(s.totalPower))
+	// 300 からは更に 2 倍の 60
+	assert.Equal(0, big.NewInt(4000+30*100+60*100).Cmp(s.milliIsuAt(400)))
+
+	status, err := s.calcStatus()
+	assert.Nil(err)
+	assert.Equal(Exponential{30, 0}, status.Schedule[0].TotalPower)
+	assert.Equal(Exponential{60, 0}, status.Schedule[1].TotalPower)
+	for _, item := range status.Items {
+		if item.ItemID != 1 {
+			continue
+		}
+		assert.Equal(Exponential{30, 0}, item.Power)
+		// 自分は建てていないが相乗効果で power が変わる
+		assert.Equal([]Building{{Time: 300, CountBuilt: 1, Power: Exponential{60, 0}}}, item.Building)
+	}
+
+	s.advance(400)
+	assert.Equal(0, big.NewInt(4000+30*100+60*100).Cmp(s.milliIsu))
+
+	err = validateCatalog(map[int]*mItem{
+		1: {ItemID: 1, PowerFormula: free, PriceFormula: free, Synergy: &SynergySpec{Target: 5, Factor: 0}},
+	}, nil)
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "item 1: synergy target item 5 does not exist")
+		assert.Contains(err.Error(), "item 1: synergy factor 0 is less than 1")
+	}
+}
+
+func TestAddPower(t *testing.T) {
+	assert := assert.New(t)
+
+	mItems := map[int]*mItem{
+		1: {ItemID: 1},
+		2: {ItemID: 2, Synergy: &SynergySpec{Target: 1, Factor: 3}},
+		3: {ItemID: 3, Synergy: &SynergySpec{Target: 0, Factor: 2}},
+	}
+	itemPower := map[int]*big.Int{1: big.NewInt(0), 2: big.NewInt(0), 3: big.NewInt(0)}
+	multipliers := map[int]*big.Int{}
+
+	assert.Equal(int64(10), addPower(mItems, itemPower, multipliers, 1, big.NewInt(10)).Int64())
+	// 1 の power 10 が 30 になる
+	assert.Equal(int64(1+20), addPower(mItems, itemPower, multipliers, 2, big.NewInt(1)).Int64())
+	// 全ての power 30 + 1 + 5 が 2 倍になる
+	assert.Equal(int64(5+36), addPower(mItems, itemPower, multipliers, 3, big.NewInt(5)).Int64())
+	assert.Equal(int64(6), multipliers[1].Int64())
+	assert.Equal(int64(2), multipliers[2].Int64())
+	assert.Equal(int64(2), multipliers[3].Int64())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"compress/flate"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+)
+
+var wsUpgrader *websocket.Upgrader
+
+// wsCompressionLevel は permessage-deflate がネゴシエートされた接続で使う圧縮レベル
+var wsCompressionLevel = flate.BestSpeed
+
+// initWsUpgrader は config.WebSocket から websocket.Upgrader を作る
+func initWsUpgrader() {
+	c := config.WebSocket
+	wsCompressionLevel = c.CompressionLevel
+
+	wsUpgrader = &websocket.Upgrader{
+		ReadBufferSize:    c.ReadBufferSize,
+		WriteBufferSize:   c.WriteBufferSize,
+		EnableCompression: c.Compression,
+		Subprotocols:      c.Subprotocols,
+		CheckOrigin:       newOriginChecker(c.AllowedOrigins),
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			log.Println("Failed to upgrade", r.RemoteAddr, reason)
+			w.Header().Set("Sec-Websocket-Version", "13")
+			http.Error(w, http.StatusText(status), status)
+		},
+	}
+	log.Printf("websocket: compression=%v level=%d buffer=%d/%d subprotocols=%v",
+		wsUpgrader.EnableCompression, wsCompressionLevel,
+		wsUpgrader.ReadBufferSize, wsUpgrader.WriteBufferSize, wsUpgrader.Subprotocols)
+}
+
+// newOriginChecker は Origin ヘッダのホストが allowed に含まれる場合だけ許可する。
+// allowed が空の場合と Origin ヘッダが無い場合 (ブラウザ以外のクライアント) は常に許可する
+func newOriginChecker(allowed []string) func(r *http.Request) bool {
+	if len(allowed) == 0 {
+		return func(r *http.Request) bool { return true }
+	}
+	hosts := map[string]bool{}
+	for _, h := range allowed {
+		hosts[h] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return hosts[u.Host]
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOriginChecker(t *testing.T) {
+	req := func(origin string) *http.Request {
+		r, _ := http.NewRequest("GET", "http://app.example.com/ws/room", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		return r
+	}
+
+	allowAll := newOriginChecker(nil)
+	assert.True(t, allowAll(req("http://evil.example.com")))
+
+	check := newOriginChecker([]string{"app.example.com", "localhost:5000"})
+	assert.True(t, check(req("")))
+	assert.True(t, check(req("http://app.example.com")))
+	assert.True(t, check(req("http://localhost:5000")))
+	assert.False(t, check(req("http://localhost:8080")))
+	assert.False(t, check(req("http://evil.example.com")))
+	assert.False(t, check(req("://bad")))
+}